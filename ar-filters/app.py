@@ -6,7 +6,24 @@ import numpy as np
 import mediapipe as mp
 import socket
 import struct
+import time
 
+# Handshake and frame header, see client/ar_protocol.go
+# Handshake: magic, version, payload format, JPEG quality, status
+HANDSHAKE = struct.Struct('!IBBBB')
+# Frame: magic, version, payload format, reserved, frame ID, timestamp, width, height, payload size,
+# processing time in microseconds
+HEADER = struct.Struct('!IBBHQqIIII')
+MAGIC = 0x41524652
+PROTOCOL_VERSION = 3
+MAX_FRAME_SIZE = 64 << 20
+
+FORMAT_RGBA = 1
+FORMAT_BGR = 2
+FORMAT_YUV420P = 3
+FORMAT_PNG = 4
+FORMAT_JPEG = 5
+SUPPORTED_FORMATS = (FORMAT_RGBA, FORMAT_BGR, FORMAT_YUV420P, FORMAT_PNG, FORMAT_JPEG)
 
 mp_face_mesh = mp.solutions.face_mesh
 face_mesh_videos = mp_face_mesh.FaceMesh(static_image_mode=False, max_num_faces=1, min_detection_confidence=0.5, min_tracking_confidence=0.3)
@@ -89,45 +106,108 @@ def add_filter_on_frame(frame):
     
     return frame
 
-def main():
-    server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-    server_socket.bind(('localhost', 5005))
-    server_socket.listen(1)
-    print("Server is listening for incoming frames...")
-    conn, addr = server_socket.accept()
-    print(f"Connection established with {addr}")
+def recv_exact(conn, size):
+    data = bytearray()
+    while len(data) < size:
+        packet = conn.recv(size - len(data))
+        if not packet:
+            return None
+        data.extend(packet)
+    return bytes(data)
 
-    while True:
-        raw_size = conn.recv(4)
-        if not raw_size:
+def handshake(conn):
+    raw = recv_exact(conn, HANDSHAKE.size)
+    if raw is None:
+        return None, None
+    magic, version, payload_format, quality, _ = HANDSHAKE.unpack(raw)
+    accepted = magic == MAGIC and version == PROTOCOL_VERSION and payload_format in SUPPORTED_FORMATS
+    conn.sendall(HANDSHAKE.pack(MAGIC, PROTOCOL_VERSION, payload_format, quality, 0 if accepted else 1))
+    if not accepted:
+        print(f"Rejected handshake (magic {magic:#x}, version {version}, format {payload_format})")
+        return None, None
+    return payload_format, quality
+
+def decode_frame(payload_format, data, width, height):
+    nparr = np.frombuffer(data, np.uint8)
+    if payload_format == FORMAT_RGBA:
+        return cv2.cvtColor(nparr.reshape(height, width, 4), cv2.COLOR_RGBA2BGR)
+    if payload_format == FORMAT_BGR:
+        return nparr.reshape(height, width, 3)
+    if payload_format == FORMAT_YUV420P:
+        return cv2.cvtColor(nparr.reshape(height * 3 // 2, width), cv2.COLOR_YUV2BGR_I420)
+    return cv2.imdecode(nparr, cv2.IMREAD_COLOR)
+
+def encode_frame(payload_format, quality, frame):
+    if payload_format == FORMAT_RGBA:
+        return cv2.cvtColor(frame, cv2.COLOR_BGR2RGBA).tobytes()
+    if payload_format == FORMAT_BGR:
+        return np.ascontiguousarray(frame).tobytes()
+    if payload_format == FORMAT_YUV420P:
+        return cv2.cvtColor(frame, cv2.COLOR_BGR2YUV_I420).tobytes()
+    if payload_format == FORMAT_PNG:
+        _, buffer = cv2.imencode('.png', frame, [cv2.IMWRITE_PNG_COMPRESSION, 1])
+        return buffer.tobytes()
+    _, buffer = cv2.imencode('.jpg', frame, [cv2.IMWRITE_JPEG_QUALITY, quality])
+    return buffer.tobytes()
+
+def serve(conn):
+    payload_format, quality = handshake(conn)
+    while payload_format is not None:
+        raw_header = recv_exact(conn, HEADER.size)
+        if raw_header is None:
             break
-        
-        frame_size = struct.unpack('!I', raw_size)[0]
-        frame_data = bytearray()
-        
-        while len(frame_data) < frame_size:
-            packet = conn.recv(frame_size - len(frame_data))
-            if not packet:
-                break
-            frame_data.extend(packet)
-
-        nparr = np.frombuffer(frame_data, np.uint8)
-        frame = cv2.imdecode(nparr, cv2.IMREAD_UNCHANGED)
+
+        magic, version, frame_format, _, frame_id, timestamp, width, height, frame_size, _ = HEADER.unpack(raw_header)
+        if magic != MAGIC or version != PROTOCOL_VERSION or frame_format != payload_format or frame_size > MAX_FRAME_SIZE:
+            print(f"Invalid frame header (magic {magic:#x}, version {version}, size {frame_size}), closing connection")
+            break
+
+        frame_data = recv_exact(conn, frame_size)
+        if frame_data is None:
+            break
+
+        # Reported to the client, which tells it apart from the network in the round trip
+        started = time.perf_counter()
+        frame = decode_frame(payload_format, frame_data, width, height)
         try:
             new_frame = add_filter_on_frame(frame)
         except Exception as e:
             print("Failed to add filter: "+str(e))
             new_frame = frame
 
-        _, buffer = cv2.imencode('.jpg', new_frame)
+        buffer = encode_frame(payload_format, quality, new_frame)
         # output_file_path = 'output.jpg' 
         # with open(output_file_path, 'wb') as f:
         #     f.write(buffer)
         # print("Sending back processed image")
-        conn.sendall(struct.pack('!I', len(buffer)) + buffer.tobytes())
+        height, width = new_frame.shape[:2]
+        processing = int((time.perf_counter() - started) * 1e6)
+        header = HEADER.pack(MAGIC, PROTOCOL_VERSION, payload_format, 0, frame_id, timestamp, width, height, len(buffer), processing)
+        conn.sendall(header + buffer)
 
-    conn.close()
-    server_socket.close()
+def main():
+    server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+    server_socket.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    # Several instances can run side by side, e.g. python3 app.py 0.0.0.0:5006
+    host, port = 'localhost', 5005
+    if len(sys.argv) > 1:
+        host, _, port = sys.argv[1].rpartition(':')
+        host, port = host or 'localhost', int(port)
+    server_socket.bind((host, port))
+    server_socket.listen(1)
+    print("Server is listening for incoming frames...")
+
+    # The client reconnects after timeouts and errors, serve one connection after the other
+    while True:
+        conn, addr = server_socket.accept()
+        print(f"Connection established with {addr}")
+        try:
+            serve(conn)
+        except OSError as e:
+            print(f"Connection with {addr} failed: {e}")
+        finally:
+            conn.close()
+        print(f"Connection with {addr} closed")
         
     
 if __name__ == "__main__":
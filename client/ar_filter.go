@@ -0,0 +1,432 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asticode/go-astiav"
+)
+
+// Delays between attempts to reach the AR service, doubling from the first to the last
+const (
+	arReconnectMinBackoff = 250 * time.Millisecond
+	arReconnectMaxBackoff = 10 * time.Second
+)
+
+// errARUnavailable answers the frames sent while there is no connection to the AR service
+var errARUnavailable = errors.New("AR service unavailable")
+
+// errARSkipped answers the frames the scheduler did not send, as no endpoint was expected
+// to process them within the latency budget
+var errARSkipped = errors.New("AR frame skipped")
+
+// arRequest is a frame sent to the AR service, waiting for its answer
+type arRequest struct {
+	frameID uint64
+	// frame is the frame sent, in the pixel format of the payload. It goes on unprocessed
+	// when no answer arrives.
+	frame  *astiav.Frame
+	sentAt time.Time
+	// deadline is when the answer has to be there, the connection is given up otherwise
+	deadline time.Time
+	result   chan arResult
+	// endpoint is where the frame was sent, nil when none was available
+	endpoint *arEndpoint
+}
+
+// arResult is the answer of the AR service to a request
+type arResult struct {
+	header     arFrameHeader
+	payload    []byte
+	receivedAt time.Time
+	err        error
+}
+
+// arConn is a connection to the AR service. Frames are written by the filter while the
+// answers are read in the background, in the order the frames were sent.
+type arConn struct {
+	address string
+	conn    net.Conn
+	format  arFormat
+	quality int
+
+	// requests holds the frames sent and not answered yet, inFlight counts them
+	requests  chan *arRequest
+	inFlight  atomic.Int32
+	slotFreed chan struct{}
+	failed    atomic.Bool
+	closeOnce sync.Once
+}
+
+// dialARConn connects to the AR service and agrees on the payload format, within the
+// timeout. Up to maxInFlight frames can be sent before their answers are read; slotFreed
+// is signalled whenever one of them is answered.
+func dialARConn(address string, format arFormat, quality int, maxInFlight int, timeout time.Duration, slotFreed chan struct{}) (*arConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := arHandshake(conn, format, quality); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &arConn{
+		address:   address,
+		conn:      conn,
+		format:    format,
+		quality:   quality,
+		requests:  make(chan *arRequest, maxInFlight),
+		slotFreed: slotFreed,
+	}
+	go c.readAnswers()
+	return c, nil
+}
+
+// send writes the frame of a request. Its answer, or the error that prevented it, is
+// delivered on the request's result channel by its deadline.
+func (c *arConn) send(req *arRequest, timestamp int64) {
+	// Queued before writing, so the reader knows which frame the next answer belongs to
+	c.inFlight.Add(1)
+	c.requests <- req
+	c.conn.SetWriteDeadline(req.deadline)
+	if err := processImageFrame(c.conn, req.frame, req.frameID, timestamp, c.format, c.quality); err != nil {
+		c.fail(err)
+	}
+}
+
+// readAnswers reads the answers to the requests in order, until the connection is closed.
+// After an error, the stream cannot be trusted anymore and the remaining requests fail.
+func (c *arConn) readAnswers() {
+	var err error
+	for req := range c.requests {
+		if err != nil {
+			c.answer(req, arResult{err: err})
+			continue
+		}
+		c.conn.SetReadDeadline(req.deadline)
+		var result arResult
+		result.header, result.payload, result.err = readARFrame(c.conn, req.frameID, c.format)
+		result.receivedAt = time.Now()
+		if result.err != nil {
+			var netErr net.Error
+			if errors.As(result.err, &netErr) && netErr.Timeout() {
+				result.err = fmt.Errorf("frame %d not answered in time: %w", req.frameID, result.err)
+			}
+			err = result.err
+			c.fail(err)
+		}
+		c.answer(req, result)
+	}
+}
+
+// answer delivers the result of a request and makes room for another one
+func (c *arConn) answer(req *arRequest, result arResult) {
+	req.result <- result
+	c.inFlight.Add(-1)
+	select {
+	case c.slotFreed <- struct{}{}:
+	default:
+	}
+}
+
+// fail marks the connection as unusable, unblocking the reader
+func (c *arConn) fail(err error) {
+	if !c.failed.Swap(true) {
+		fmt.Printf("Connection to the AR service at %s failed: %v\n", c.address, err)
+	}
+	c.conn.Close()
+}
+
+// close closes the connection. Requests still in flight fail.
+func (c *arConn) close() {
+	c.closeOnce.Do(func() {
+		c.failed.Store(true)
+		c.conn.Close()
+		close(c.requests)
+	})
+}
+
+// arFilter is the FrameFilter sending frames to the AR service and returning the frames
+// it processed. Frames are converted to the pixel format of the payload on the way.
+// Frames are spread over the endpoints of the service by the balancer, each endpoint
+// taking up to ARConfig.MaxInFlight frames ahead of their answers. The processed frames
+// come out in the order they went in, each call returning the answers that are there, so a
+// filter with more than one frame in flight returns none until the first answer arrives.
+//
+// Whether a frame goes to the local or the edge endpoints, or is skipped, is left to the
+// scheduler, from the latency measured at each endpoint.
+//
+// A frame not answered within ARConfig.Timeout takes the connection to its endpoint down.
+// Endpoints that are down are reconnected with backoff, and while all of them are, frames
+// go on unprocessed.
+type arFilter struct {
+	config    ARConfig
+	format    arFormat
+	endpoints []*arEndpoint
+	balancer  arBalancer
+	scheduler *arScheduler
+	// tunnel is the SSH tunnel to the edge node, when the filter opened one
+	tunnel *exec.Cmd
+	// slotFreed is signalled whenever an endpoint answered a frame
+	slotFreed chan struct{}
+
+	// Frames are numbered so that answers can be matched to them
+	nextFrameID uint64
+	timeBase    astiav.Rational
+	// pending holds the requests in the order the frames were sent
+	pending []*arRequest
+
+	convertContext *astiav.SoftwareScaleContext
+	convertFrame   *astiav.Frame
+	// delivered are the frames returned by the previous call
+	delivered []*astiav.Frame
+}
+
+func newARFilter(config ARConfig) (*arFilter, error) {
+	format, err := parseARFormat(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	balancer, err := newARBalancer(config.Balancer)
+	if err != nil {
+		return nil, err
+	}
+	scheduler, err := newARScheduler(config)
+	if err != nil {
+		return nil, err
+	}
+	var tunnel *exec.Cmd
+	if config.EdgeSSH != "" {
+		if tunnel, err = establishSSHTunnel(config.EdgeSSHTunnel, config.EdgeSSH, config.EdgeSSHJump, config.EdgeSSHIdentity); err != nil {
+			scheduler.close()
+			return nil, err
+		}
+	}
+
+	f := &arFilter{
+		config:       config,
+		format:       format,
+		balancer:     balancer,
+		scheduler:    scheduler,
+		tunnel:       tunnel,
+		slotFreed:    make(chan struct{}, 1),
+		convertFrame: astiav.AllocFrame(),
+	}
+	f.addEndpoints(config.Addresses, arTierLocal)
+	f.addEndpoints(config.EdgeAddresses, arTierEdge)
+	return f, nil
+}
+
+func (f *arFilter) addEndpoints(addresses []string, tier string) {
+	for _, address := range addresses {
+		if address = strings.TrimSpace(address); address != "" {
+			f.endpoints = append(f.endpoints, &arEndpoint{address: address, tier: tier})
+		}
+	}
+}
+
+func (f *arFilter) Init(format astiav.PixelFormat, width, height int, timeBase astiav.Rational) error {
+	f.timeBase = timeBase
+
+	if f.convertContext != nil {
+		f.convertContext.Free()
+		f.convertContext = nil
+	}
+	f.convertFrame.Unref()
+
+	// The chroma of yuv420p covers two pixels each way, so the service only gets even sizes
+	// and odd ones lose their last row or column
+	convertWidth, convertHeight := width, height
+	if f.format == arFormatYUV420P {
+		convertWidth, convertHeight = max(width&^1, 2), max(height&^1, 2)
+	}
+	if format == f.format.pixelFormat() && convertWidth == width && convertHeight == height {
+		return nil
+	}
+
+	// create a scale context to convert frames to the pixel format and size of the payload
+	var err error
+	f.convertContext, err = astiav.CreateSoftwareScaleContext(
+		width,
+		height,
+		format,
+		convertWidth,
+		convertHeight,
+		f.format.pixelFormat(),
+		astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear),
+	)
+	return err
+}
+
+// pickEndpoint returns the endpoint the scheduler chose for the next frame, waiting while
+// the endpoints it may go to have their maximum of frames in flight. It fails with
+// errARUnavailable when all endpoints are down and errARSkipped when the frame is skipped.
+func (f *arFilter) pickEndpoint(frameID uint64) (*arEndpoint, error) {
+	for {
+		up := false
+		for _, endpoint := range f.endpoints {
+			if endpoint.connect(f.config, f.format, f.slotFreed) {
+				up = true
+			}
+		}
+		if !up {
+			return nil, errARUnavailable
+		}
+
+		local, edge := f.scheduler.estimate(f.endpoints, arTierLocal), f.scheduler.estimate(f.endpoints, arTierEdge)
+		decision, candidates := f.scheduler.decide(f.endpoints, local, edge)
+		if decision == arDecisionSkip {
+			f.scheduler.record(frameID, decision, nil, local, edge)
+			return nil, errARSkipped
+		}
+		if len(candidates) > 0 {
+			endpoint := f.balancer.pick(candidates)
+			f.scheduler.record(frameID, decision, endpoint, local, edge)
+			endpoint.lastSentAt = time.Now()
+			return endpoint, nil
+		}
+		// Every frame in flight is answered by its deadline
+		<-f.slotFreed
+	}
+}
+
+func (f *arFilter) Process(frame *astiav.Frame) ([]*astiav.Frame, error) {
+	f.freeDelivered()
+
+	// The frame is kept until its answer arrives, so it gets its own reference
+	var sent *astiav.Frame
+	if f.convertContext != nil {
+		// A new buffer for every frame, the previous ones may still be in flight
+		f.convertFrame.Unref()
+		if err := f.convertContext.ScaleFrame(frame, f.convertFrame); err != nil {
+			return nil, err
+		}
+		// Keep the decoder timestamp through the AR stage
+		f.convertFrame.SetPts(frame.Pts())
+		sent = f.convertFrame.Clone()
+	} else {
+		sent = frame.Clone()
+	}
+
+	var timestamp int64
+	if pts := frame.Pts(); pts != astiav.NoPtsValue {
+		timestamp = astiav.RescaleQ(pts, f.timeBase, astiav.NewRational(1, 1000000))
+	}
+
+	now := time.Now()
+	req := &arRequest{frameID: f.nextFrameID, frame: sent, sentAt: now, deadline: now.Add(f.config.Timeout), result: make(chan arResult, 1)}
+	f.nextFrameID++
+	var err error
+	if req.endpoint, err = f.pickEndpoint(req.frameID); err == nil {
+		req.endpoint.conn.send(req, timestamp)
+	} else {
+		// Queued like the others, so that the frames before it still come out first
+		req.result <- arResult{err: err}
+	}
+	f.pending = append(f.pending, req)
+
+	// Wait for the oldest answer while the window of all endpoints is full, then take every
+	// answer that is there, so that the frames in flight go back down after a slow answer.
+	// Answers arrive by the deadline of their request.
+	for len(f.pending) > 0 {
+		oldest := f.pending[0]
+		var result arResult
+		if len(f.pending) >= f.config.MaxInFlight*len(f.endpoints) {
+			result = <-oldest.result
+		} else {
+			select {
+			case result = <-oldest.result:
+			default:
+				return f.delivered, nil
+			}
+		}
+		f.pending = f.pending[1:]
+		f.delivered = append(f.delivered, f.deliver(oldest, result))
+	}
+	return f.delivered, nil
+}
+
+// Flush waits for the answers to the frames in flight and returns their frames
+func (f *arFilter) Flush() ([]*astiav.Frame, error) {
+	f.freeDelivered()
+	for _, req := range f.pending {
+		f.delivered = append(f.delivered, f.deliver(req, <-req.result))
+	}
+	f.pending = nil
+	return f.delivered, nil
+}
+
+func (f *arFilter) freeDelivered() {
+	freeFrames(f.delivered)
+	f.delivered = nil
+}
+
+// arInFlight reports whether an AR filter of the chain has frames waiting for their answers
+func (c *filterChain) arInFlight() bool {
+	for _, stage := range c.stages {
+		if f, ok := stage.filter.(*arFilter); ok && len(f.pending) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver returns the processed frame of a request, or the frame sent when processing failed
+func (f *arFilter) deliver(req *arRequest, result arResult) *astiav.Frame {
+	if result.err != nil {
+		// The frame goes on unprocessed, the connection or the scheduler already reported why
+		if !errors.Is(result.err, errARSkipped) {
+			stats.arUnprocessedFrames.Add(1)
+		}
+		return req.frame
+	}
+	roundTrip := result.receivedAt.Sub(req.sentAt)
+	stats.arLatency.add(roundTrip)
+	req.endpoint.latency.add(roundTrip)
+	req.endpoint.processing.add(result.header.processingTime)
+	req.endpoint.network.add(max(roundTrip-result.header.processingTime, 0))
+
+	processedFrame, err := processedFrameFromPayload(result.header, result.payload, f.format, req.frame)
+	if err != nil {
+		fmt.Println("Failed to add AR filter to frame: ", err)
+		stats.arUnprocessedFrames.Add(1)
+		return req.frame
+	}
+	req.frame.Free()
+	return processedFrame
+}
+
+func (f *arFilter) Close() error {
+	for _, endpoint := range f.endpoints {
+		endpoint.close()
+	}
+	if err := f.scheduler.close(); err != nil {
+		fmt.Println("Failed to write the AR decision log: ", err)
+	}
+	if f.tunnel != nil {
+		if err := closeSSHTunnel(f.tunnel); err != nil {
+			fmt.Println(err)
+		}
+		f.tunnel = nil
+	}
+	for _, req := range f.pending {
+		req.frame.Free()
+	}
+	f.pending = nil
+	f.freeDelivered()
+	if f.convertContext != nil {
+		f.convertContext.Free()
+		f.convertContext = nil
+	}
+	f.convertFrame.Free()
+	return nil
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// arEndpoint is one instance of the AR service, local or on an edge node, with the state
+// of the connection to it
+type arEndpoint struct {
+	address string
+	// tier is arTierLocal or arTierEdge
+	tier string
+	conn *arConn
+
+	// Connection state, up after the handshake succeeded. dialing is set while a connection
+	// is being made in the background.
+	up         bool
+	dialing    chan arDialResult
+	backoff    time.Duration
+	nextDialAt time.Time
+
+	// latency is the round trip of the frames answered by this endpoint, split into the
+	// processing time reported by the service and the rest, spent on the network
+	latency    ewma
+	processing ewma
+	network    ewma
+	lastSentAt time.Time
+}
+
+// arDialResult is the outcome of connecting to an endpoint
+type arDialResult struct {
+	conn *arConn
+	err  error
+}
+
+// hasRoom reports whether the endpoint is up and can take another frame
+func (e *arEndpoint) hasRoom(maxInFlight int) bool {
+	return e.conn != nil && int(e.conn.inFlight.Load()) < maxInFlight
+}
+
+// connect reports whether there is a usable connection to the endpoint, reconnecting when
+// the backoff allows. Requests in flight on a failed connection are answered with its error.
+// Connections are made in the background, so that an unreachable endpoint does not hold
+// the frames back, and the endpoint is unavailable until the handshake is done.
+func (e *arEndpoint) connect(config ARConfig, format arFormat, slotFreed chan struct{}) bool {
+	if e.conn != nil && !e.conn.failed.Load() {
+		return true
+	}
+	if e.conn != nil {
+		e.conn.close()
+		e.conn = nil
+	}
+	if e.up {
+		e.up = false
+		stats.arDisconnects.Add(1)
+		fmt.Printf("AR service at %s (%s) is down\n", e.address, e.tier)
+	}
+	if e.dialing == nil {
+		if time.Now().Before(e.nextDialAt) {
+			return false
+		}
+		e.dialing = make(chan arDialResult, 1)
+		go func(dialing chan<- arDialResult) {
+			conn, err := dialARConn(e.address, format, config.JPEGQuality, config.MaxInFlight, config.Timeout, slotFreed)
+			dialing <- arDialResult{conn: conn, err: err}
+		}(e.dialing)
+		return false
+	}
+
+	var result arDialResult
+	select {
+	case result = <-e.dialing:
+		e.dialing = nil
+	default:
+		return false
+	}
+	if result.err != nil {
+		e.backoff = min(max(2*e.backoff, arReconnectMinBackoff), arReconnectMaxBackoff)
+		e.nextDialAt = time.Now().Add(e.backoff)
+		fmt.Printf("AR service at %s unavailable, retrying in %v: %v\n", e.address, e.backoff, result.err)
+		return false
+	}
+	e.conn = result.conn
+	e.up = true
+	e.backoff = 0
+	stats.arConnects.Add(1)
+	fmt.Printf("AR service at %s (%s) is up, sending %s frames with up to %d in flight\n", e.address, e.tier, format, config.MaxInFlight)
+	return true
+}
+
+func (e *arEndpoint) close() {
+	if e.conn != nil {
+		e.conn.close()
+		e.conn = nil
+	}
+	// A connection still being made is closed once it is there
+	if e.dialing != nil {
+		go func(dialing <-chan arDialResult) {
+			if result := <-dialing; result.conn != nil {
+				result.conn.close()
+			}
+		}(e.dialing)
+		e.dialing = nil
+	}
+}
+
+// arBalancer picks the endpoint the next frame goes to, among endpoints that are up and
+// have room for another frame
+type arBalancer interface {
+	pick(endpoints []*arEndpoint) *arEndpoint
+}
+
+// arBalancerNames lists the balancers that can be selected on the command line
+var arBalancerNames = []string{"round_robin", "least_latency"}
+
+func newARBalancer(name string) (arBalancer, error) {
+	switch name {
+	case "round_robin":
+		return &roundRobinBalancer{}, nil
+	case "least_latency":
+		return leastLatencyBalancer{}, nil
+	}
+	return nil, fmt.Errorf("unknown AR balancer %q, expected round_robin or least_latency", name)
+}
+
+// roundRobinBalancer hands frames to the endpoints in turn
+type roundRobinBalancer struct {
+	next int
+}
+
+func (b *roundRobinBalancer) pick(endpoints []*arEndpoint) *arEndpoint {
+	b.next %= len(endpoints)
+	endpoint := endpoints[b.next]
+	b.next++
+	return endpoint
+}
+
+// leastLatencyBalancer hands frames to the endpoint expected to answer first, from its
+// round trip and the frames it still has to answer. Endpoints without an answer yet are
+// tried first.
+type leastLatencyBalancer struct{}
+
+func (leastLatencyBalancer) pick(endpoints []*arEndpoint) *arEndpoint {
+	var best *arEndpoint
+	var bestLatency time.Duration
+	for _, endpoint := range endpoints {
+		latency := endpoint.latency.get() * time.Duration(endpoint.conn.inFlight.Load()+1)
+		if best == nil || latency < bestLatency {
+			best, bestLatency = endpoint, latency
+		}
+	}
+	return best
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/asticode/go-astiav"
+)
+
+// A connection to the AR service starts with a handshake choosing the payload format.
+// The client sends, and the service answers with, all fields big endian:
+//
+//	magic        uint32  "ARFR"
+//	version      uint8   arProtocolVersion
+//	format       uint8   payload format, see arFormat
+//	quality      uint8   JPEG quality, 0 for other formats
+//	status       uint8   0 from the client; 0 accepted or 1 rejected from the service
+//
+// Frames are then exchanged as a fixed size header followed by the payload:
+//
+//	magic        uint32  "ARFR"
+//	version      uint8   arProtocolVersion
+//	format       uint8   the negotiated payload format
+//	reserved     uint16  0
+//	frameID      uint64  echoed by the service
+//	timestamp    int64   frame pts in microseconds, echoed by the service
+//	width        uint32
+//	height       uint32
+//	payloadSize  uint32  bytes following the header
+//	processing   uint32  time the service spent on the frame in microseconds, 0 from the client
+//
+// The service answers every frame with a frame of the same ID and format, so a header that
+// does not match means the stream can no longer be trusted.
+const (
+	arMagic           uint32 = 0x41524652
+	arProtocolVersion uint8  = 3
+	arHandshakeSize          = 8
+	arHeaderSize             = 40
+
+	// maxARFrameSize bounds the payload accepted from the service, a raw 4K RGBA frame fits
+	maxARFrameSize = 64 << 20
+	// maxARFrameDimension bounds the width and height accepted from the service
+	maxARFrameDimension = 8192
+)
+
+// arFormat is the payload format of the frames exchanged with the AR service. Raw formats
+// carry the pixels without padding, images are encoded from RGBA.
+type arFormat uint8
+
+const (
+	arFormatRGBA    arFormat = 1
+	arFormatBGR     arFormat = 2
+	arFormatYUV420P arFormat = 3
+	arFormatPNG     arFormat = 4
+	arFormatJPEG    arFormat = 5
+)
+
+// arFormatNames maps the names accepted on the command line to the formats
+var arFormatNames = map[string]arFormat{
+	"rgba":    arFormatRGBA,
+	"bgr":     arFormatBGR,
+	"yuv420p": arFormatYUV420P,
+	"png":     arFormatPNG,
+	"jpeg":    arFormatJPEG,
+}
+
+func parseARFormat(name string) (arFormat, error) {
+	if format, ok := arFormatNames[name]; ok {
+		return format, nil
+	}
+	return 0, fmt.Errorf("unknown AR payload format %q, expected rgba, bgr, yuv420p, png or jpeg", name)
+}
+
+func (f arFormat) String() string {
+	for name, format := range arFormatNames {
+		if format == f {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(f))
+}
+
+// raw reports whether the payload is the frame data itself rather than an encoded image
+func (f arFormat) raw() bool {
+	return f == arFormatRGBA || f == arFormatBGR || f == arFormatYUV420P
+}
+
+// pixelFormat returns the pixel format frames are converted to before they are sent
+func (f arFormat) pixelFormat() astiav.PixelFormat {
+	switch f {
+	case arFormatBGR:
+		return astiav.PixelFormatBgr24
+	case arFormatYUV420P:
+		return astiav.PixelFormatYuv420P
+	}
+	return astiav.PixelFormatRgba
+}
+
+// arHandshake asks the service for the payload format and waits for its answer
+func arHandshake(rw io.ReadWriter, format arFormat, quality int) error {
+	buf := make([]byte, arHandshakeSize)
+	binary.BigEndian.PutUint32(buf[0:], arMagic)
+	buf[4] = arProtocolVersion
+	buf[5] = uint8(format)
+	if format == arFormatJPEG {
+		buf[6] = uint8(quality)
+	}
+	if _, err := rw.Write(buf); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if magic := binary.BigEndian.Uint32(buf[0:]); magic != arMagic {
+		return fmt.Errorf("%w: bad magic %#x in handshake", errARDesync, magic)
+	}
+	if version := buf[4]; version != arProtocolVersion {
+		return fmt.Errorf("AR service speaks protocol version %d, expected %d", version, arProtocolVersion)
+	}
+	if buf[7] != 0 || arFormat(buf[5]) != format {
+		return fmt.Errorf("AR service rejected the %s payload format", format)
+	}
+	return nil
+}
+
+// errARDesync is returned when a header read from the service is not the expected one.
+// The connection has to be closed, as the next bytes cannot be located in the stream.
+var errARDesync = errors.New("AR stream out of sync")
+
+type arFrameHeader struct {
+	format      arFormat
+	frameID     uint64
+	timestamp   int64
+	width       int
+	height      int
+	payloadSize int
+	// processingTime is reported by the service, the rest of the round trip is the network
+	processingTime time.Duration
+}
+
+// writeARFrame writes a header and its payload
+func writeARFrame(w io.Writer, header arFrameHeader, payload []byte) error {
+	if len(payload) > maxARFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", len(payload), maxARFrameSize)
+	}
+
+	buf := make([]byte, arHeaderSize, arHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], arMagic)
+	buf[4] = arProtocolVersion
+	buf[5] = uint8(header.format)
+	binary.BigEndian.PutUint64(buf[8:], header.frameID)
+	binary.BigEndian.PutUint64(buf[16:], uint64(header.timestamp))
+	binary.BigEndian.PutUint32(buf[24:], uint32(header.width))
+	binary.BigEndian.PutUint32(buf[28:], uint32(header.height))
+	binary.BigEndian.PutUint32(buf[32:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[36:], uint32(header.processingTime/time.Microsecond))
+
+	// A single write keeps header and payload together in as few segments as possible
+	if _, err := w.Write(append(buf, payload...)); err != nil {
+		return fmt.Errorf("failed to send frame: %w", err)
+	}
+	return nil
+}
+
+// readARFrame reads the answer to the frame with the given ID, header and payload in full
+func readARFrame(r io.Reader, frameID uint64, format arFormat) (arFrameHeader, []byte, error) {
+	buf := make([]byte, arHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return arFrameHeader{}, nil, fmt.Errorf("failed to read frame header: %w", err)
+	}
+
+	if magic := binary.BigEndian.Uint32(buf[0:]); magic != arMagic {
+		return arFrameHeader{}, nil, fmt.Errorf("%w: bad magic %#x", errARDesync, magic)
+	}
+	if version := buf[4]; version != arProtocolVersion {
+		return arFrameHeader{}, nil, fmt.Errorf("%w: protocol version %d, expected %d", errARDesync, version, arProtocolVersion)
+	}
+	header := arFrameHeader{
+		format:      arFormat(buf[5]),
+		frameID:     binary.BigEndian.Uint64(buf[8:]),
+		timestamp:   int64(binary.BigEndian.Uint64(buf[16:])),
+		width:       int(binary.BigEndian.Uint32(buf[24:])),
+		height:      int(binary.BigEndian.Uint32(buf[28:])),
+		payloadSize: int(binary.BigEndian.Uint32(buf[32:])),
+
+		processingTime: time.Duration(binary.BigEndian.Uint32(buf[36:])) * time.Microsecond,
+	}
+	if header.frameID != frameID {
+		return header, nil, fmt.Errorf("%w: got frame %d, expected %d", errARDesync, header.frameID, frameID)
+	}
+	if header.format != format {
+		return header, nil, fmt.Errorf("%w: got %s payload, negotiated %s", errARDesync, header.format, format)
+	}
+	if header.payloadSize > maxARFrameSize {
+		return header, nil, fmt.Errorf("%w: frame of %d bytes exceeds the maximum of %d", errARDesync, header.payloadSize, maxARFrameSize)
+	}
+	if header.width <= 0 || header.height <= 0 || header.width > maxARFrameDimension || header.height > maxARFrameDimension {
+		return header, nil, fmt.Errorf("%w: invalid frame size %dx%d", errARDesync, header.width, header.height)
+	}
+
+	payload := make([]byte, header.payloadSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return header, nil, fmt.Errorf("failed to read frame data: %w", err)
+	}
+	return header, payload, nil
+}
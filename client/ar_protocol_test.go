@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// encodeARFrame returns a header and payload as written by writeARFrame
+func encodeARFrame(t *testing.T, header arFrameHeader, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeARFrame(&buf, header, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestARFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  arFrameHeader
+		payload []byte
+	}{
+		{
+			name:    "jpeg answer",
+			header:  arFrameHeader{format: arFormatJPEG, frameID: 42, timestamp: 1234567, width: 640, height: 480, processingTime: 15 * time.Millisecond},
+			payload: []byte("not really a jpeg"),
+		},
+		{
+			name:    "raw frame",
+			header:  arFrameHeader{format: arFormatRGBA, frameID: 1 << 40, timestamp: -1, width: 2, height: 1},
+			payload: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		{
+			name:   "empty payload",
+			header: arFrameHeader{format: arFormatPNG, width: 1, height: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := encodeARFrame(t, test.header, test.payload)
+			if len(data) != arHeaderSize+len(test.payload) {
+				t.Fatalf("wrote %d bytes, expected %d", len(data), arHeaderSize+len(test.payload))
+			}
+
+			header, payload, err := readARFrame(bytes.NewReader(data), test.header.frameID, test.header.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.header
+			want.payloadSize = len(test.payload)
+			if header != want {
+				t.Errorf("read header %+v, expected %+v", header, want)
+			}
+			if !bytes.Equal(payload, test.payload) {
+				t.Errorf("read payload %q, expected %q", payload, test.payload)
+			}
+		})
+	}
+}
+
+func TestReadARFrameErrors(t *testing.T) {
+	header := arFrameHeader{format: arFormatJPEG, frameID: 7, width: 640, height: 480}
+	payload := []byte("payload")
+	valid := encodeARFrame(t, header, payload)
+
+	// corrupt returns the valid frame with the header field at offset replaced
+	corrupt := func(offset int, value uint32, size int) []byte {
+		data := bytes.Clone(valid)
+		switch size {
+		case 1:
+			data[offset] = uint8(value)
+		case 4:
+			binary.BigEndian.PutUint32(data[offset:], value)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		target error
+	}{
+		{name: "closed before the header", data: nil, target: io.EOF},
+		{name: "truncated header", data: valid[:arHeaderSize-1], target: io.ErrUnexpectedEOF},
+		{name: "truncated payload", data: valid[:len(valid)-1], target: io.ErrUnexpectedEOF},
+		{name: "bad magic", data: corrupt(0, 0x41524600, 4), target: errARDesync},
+		{name: "other version", data: corrupt(4, uint32(arProtocolVersion+1), 1), target: errARDesync},
+		{name: "other format", data: corrupt(5, uint32(arFormatPNG), 1), target: errARDesync},
+		{name: "other frame", data: corrupt(12, 8, 4), target: errARDesync},
+		{name: "oversize payload", data: corrupt(32, maxARFrameSize+1, 4), target: errARDesync},
+		{name: "zero width", data: corrupt(24, 0, 4), target: errARDesync},
+		{name: "zero height", data: corrupt(28, 0, 4), target: errARDesync},
+		{name: "oversize width", data: corrupt(24, maxARFrameDimension+1, 4), target: errARDesync},
+		{name: "huge height", data: corrupt(28, 0xffffffff, 4), target: errARDesync},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := readARFrame(bytes.NewReader(test.data), header.frameID, header.format)
+			if !errors.Is(err, test.target) {
+				t.Errorf("got error %v, expected %v", err, test.target)
+			}
+		})
+	}
+}
+
+func TestWriteARFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeARFrame(&buf, arFrameHeader{format: arFormatRGBA}, make([]byte, maxARFrameSize+1)); err == nil {
+		t.Fatal("wrote a frame larger than the maximum")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes of a rejected frame", buf.Len())
+	}
+}
+
+func TestARHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  arFormat
+		quality int
+		// answer modifies the request echoed by the service
+		answer  func(buf []byte)
+		wantErr bool
+		desync  bool
+	}{
+		{name: "accepted", format: arFormatJPEG, quality: 80, answer: func([]byte) {}},
+		{name: "quality only sent for jpeg", format: arFormatRGBA, quality: 80, answer: func([]byte) {}},
+		{name: "rejected", format: arFormatYUV420P, answer: func(buf []byte) { buf[7] = 1 }, wantErr: true},
+		{name: "other format", format: arFormatBGR, answer: func(buf []byte) { buf[5] = uint8(arFormatRGBA) }, wantErr: true},
+		{name: "other version", format: arFormatPNG, answer: func(buf []byte) { buf[4] = arProtocolVersion - 1 }, wantErr: true},
+		{name: "bad magic", format: arFormatPNG, answer: func(buf []byte) { buf[0] = 0 }, wantErr: true, desync: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, service := net.Pipe()
+			defer client.Close()
+
+			requests := make(chan []byte, 1)
+			go func() {
+				defer service.Close()
+				buf := make([]byte, arHandshakeSize)
+				if _, err := io.ReadFull(service, buf); err != nil {
+					close(requests)
+					return
+				}
+				requests <- bytes.Clone(buf)
+				test.answer(buf)
+				service.Write(buf)
+			}()
+
+			err := arHandshake(client, test.format, test.quality)
+			request := <-requests
+			if request == nil {
+				t.Fatal("no handshake received")
+			}
+			if got := binary.BigEndian.Uint32(request); got != arMagic {
+				t.Errorf("sent magic %#x", got)
+			}
+			wantQuality := uint8(0)
+			if test.format == arFormatJPEG {
+				wantQuality = uint8(test.quality)
+			}
+			if request[4] != arProtocolVersion || arFormat(request[5]) != test.format || request[6] != wantQuality || request[7] != 0 {
+				t.Errorf("sent handshake %v", request)
+			}
+
+			switch {
+			case !test.wantErr && err != nil:
+				t.Errorf("handshake failed: %v", err)
+			case test.wantErr && err == nil:
+				t.Error("handshake succeeded, expected an error")
+			case test.desync && !errors.Is(err, errARDesync):
+				t.Errorf("got error %v, expected %v", err, errARDesync)
+			}
+		})
+	}
+}
+
+func TestParseARFormat(t *testing.T) {
+	for name, format := range arFormatNames {
+		parsed, err := parseARFormat(name)
+		if err != nil || parsed != format {
+			t.Errorf("parseARFormat(%q) = %v, %v", name, parsed, err)
+		}
+		if format.String() != name {
+			t.Errorf("%d.String() = %q, expected %q", format, format.String(), name)
+		}
+	}
+	if _, err := parseARFormat("webp"); err == nil {
+		t.Error("parseARFormat(\"webp\") found a format")
+	}
+}
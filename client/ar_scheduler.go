@@ -0,0 +1,224 @@
+package client
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tiers the AR endpoints belong to, and the decisions of the scheduler besides a tier
+const (
+	arTierLocal = "local"
+	arTierEdge  = "edge"
+
+	// arDecisionAny sends the frame to any endpoint, as picked by the balancer
+	arDecisionAny = "any"
+	// arDecisionSkip passes the frame on unprocessed
+	arDecisionSkip = "skip"
+	// arDecisionProbe sends the frame to an endpoint that got none for a while
+	arDecisionProbe = "probe"
+)
+
+// arProbeInterval is how long an endpoint can go without frames before the scheduler sends
+// it one anyway, so that its latency estimate follows the load of the endpoint and network
+const arProbeInterval = 2 * time.Second
+
+// arTierEstimate is what the scheduler knows about a tier when a frame comes in
+type arTierEstimate struct {
+	// up reports whether an endpoint of the tier is connected
+	up bool
+	// known reports whether the tier answered frames, expected is then the round trip the
+	// next frame can expect at the fastest endpoint of the tier, behind the frames in flight
+	known    bool
+	expected time.Duration
+	// processing and network split the round trip of that endpoint
+	processing time.Duration
+	network    time.Duration
+}
+
+// fits reports whether a frame sent to the tier is expected back within the budget. Tiers
+// without a measurement fit, so that they get measured.
+func (e arTierEstimate) fits(budget time.Duration) bool {
+	return e.up && (!e.known || e.expected <= budget)
+}
+
+func (e arTierEstimate) String() string {
+	switch {
+	case !e.up:
+		return "down"
+	case !e.known:
+		return "not measured"
+	}
+	return fmt.Sprintf("%v (processing %v, network %v)",
+		e.expected.Round(time.Millisecond), e.processing.Round(time.Millisecond), e.network.Round(time.Millisecond))
+}
+
+// arPolicy decides where the next frame is processed from the estimates of the tiers, at
+// least one of which is up: a tier, arDecisionAny or arDecisionSkip
+type arPolicy func(local, edge arTierEstimate, budget time.Duration) string
+
+// arPolicies are the scheduling policies that can be selected on the command line
+var arPolicies = map[string]arPolicy{
+	// pool spreads frames over all endpoints without a budget
+	"pool": func(local, edge arTierEstimate, budget time.Duration) string {
+		return arDecisionAny
+	},
+	// local_first offloads to the edge when local processing exceeds the budget
+	"local_first": func(local, edge arTierEstimate, budget time.Duration) string {
+		return firstFitting(budget, arTierLocal, local, arTierEdge, edge)
+	},
+	// edge_first processes locally when offloading exceeds the budget
+	"edge_first": func(local, edge arTierEstimate, budget time.Duration) string {
+		return firstFitting(budget, arTierEdge, edge, arTierLocal, local)
+	},
+	// fastest takes the tier expected to answer first, if it is within the budget
+	"fastest": func(local, edge arTierEstimate, budget time.Duration) string {
+		if edge.fits(budget) && (!local.fits(budget) || (edge.known && local.known && edge.expected < local.expected)) {
+			return arTierEdge
+		}
+		if local.fits(budget) {
+			return arTierLocal
+		}
+		return arDecisionSkip
+	},
+}
+
+// firstFitting returns the first of two tiers within the budget, arDecisionSkip if neither is
+func firstFitting(budget time.Duration, firstTier string, first arTierEstimate, secondTier string, second arTierEstimate) string {
+	if first.fits(budget) {
+		return firstTier
+	}
+	if second.fits(budget) {
+		return secondTier
+	}
+	return arDecisionSkip
+}
+
+// arScheduler decides for every frame whether it is processed locally, offloaded to an
+// edge node or not processed at all. Decisions are printed when they change, and written
+// for every frame to the decision log when there is one.
+type arScheduler struct {
+	policyName  string
+	policy      arPolicy
+	budget      time.Duration
+	maxInFlight int
+
+	lastDecision string
+	logFile      *os.File
+	log          *csv.Writer
+}
+
+func newARScheduler(config ARConfig) (*arScheduler, error) {
+	policy, ok := arPolicies[config.Policy]
+	if !ok {
+		return nil, fmt.Errorf("unknown AR scheduling policy %q", config.Policy)
+	}
+	s := &arScheduler{policyName: config.Policy, policy: policy, budget: config.LatencyBudget, maxInFlight: config.MaxInFlight}
+	if config.DecisionLog == "" {
+		return s, nil
+	}
+
+	var err error
+	if s.logFile, err = os.Create(config.DecisionLog); err != nil {
+		return nil, fmt.Errorf("creating AR decision log failed: %w", err)
+	}
+	s.log = csv.NewWriter(s.logFile)
+	s.log.Write([]string{
+		"time_ms", "frame_id", "decision", "endpoint", "budget_ms",
+		"local_up", "local_expected_ms", "local_processing_ms", "local_network_ms",
+		"edge_up", "edge_expected_ms", "edge_processing_ms", "edge_network_ms",
+	})
+	return s, nil
+}
+
+// estimate returns what is known about the endpoints of a tier that are up
+func (s *arScheduler) estimate(endpoints []*arEndpoint, tier string) arTierEstimate {
+	var estimate arTierEstimate
+	for _, endpoint := range endpoints {
+		if endpoint.tier != tier || endpoint.conn == nil {
+			continue
+		}
+		estimate.up = true
+		if !endpoint.latency.known() {
+			continue
+		}
+		expected := endpoint.latency.get() * time.Duration(endpoint.conn.inFlight.Load()+1)
+		if !estimate.known || expected < estimate.expected {
+			estimate.known = true
+			estimate.expected = expected
+			estimate.processing = endpoint.processing.get()
+			estimate.network = endpoint.network.get()
+		}
+	}
+	return estimate
+}
+
+// decide returns the decision for the next frame and the endpoints that may take it, i.e.
+// are up and have room for another frame, given endpoints whose connections are up or nil.
+// There are no candidates when the frame is skipped or has to wait for room.
+func (s *arScheduler) decide(endpoints []*arEndpoint, local, edge arTierEstimate) (string, []*arEndpoint) {
+	if s.policyName != "pool" {
+		for _, endpoint := range endpoints {
+			if endpoint.hasRoom(s.maxInFlight) && time.Since(endpoint.lastSentAt) > arProbeInterval {
+				return arDecisionProbe, []*arEndpoint{endpoint}
+			}
+		}
+	}
+
+	decision := s.policy(local, edge, s.budget)
+	var candidates []*arEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.hasRoom(s.maxInFlight) && (decision == arDecisionAny || endpoint.tier == decision) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	return decision, candidates
+}
+
+// record logs the decision taken for a frame, endpoint is nil when it was skipped
+func (s *arScheduler) record(frameID uint64, decision string, endpoint *arEndpoint, local, edge arTierEstimate) {
+	if decision != s.lastDecision && decision != arDecisionProbe {
+		fmt.Printf("AR scheduler (%s, budget %v): %s, local %s, edge %s\n", s.policyName, s.budget, decision, local, edge)
+		s.lastDecision = decision
+	}
+
+	switch {
+	case endpoint == nil:
+		stats.arSkippedFrames.Add(1)
+	case endpoint.tier == arTierEdge:
+		stats.arEdgeFrames.Add(1)
+	default:
+		stats.arLocalFrames.Add(1)
+	}
+
+	if s.log == nil {
+		return
+	}
+	address := ""
+	if endpoint != nil {
+		address = endpoint.address
+	}
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	s.log.Write([]string{
+		strconv.FormatInt(time.Now().UnixMilli(), 10), strconv.FormatUint(frameID, 10), decision, address, ms(s.budget),
+		strconv.FormatBool(local.up), ms(local.expected), ms(local.processing), ms(local.network),
+		strconv.FormatBool(edge.up), ms(edge.expected), ms(edge.processing), ms(edge.network),
+	})
+}
+
+func (s *arScheduler) close() error {
+	if s.log == nil {
+		return nil
+	}
+	s.log.Flush()
+	err := s.log.Error()
+	if closeErr := s.logFile.Close(); err == nil {
+		err = closeErr
+	}
+	s.log = nil
+	return err
+}
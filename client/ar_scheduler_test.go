@@ -0,0 +1,124 @@
+package client
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestARPolicies(t *testing.T) {
+	budget := 100 * time.Millisecond
+	down := arTierEstimate{}
+	unmeasured := arTierEstimate{up: true}
+	fast := arTierEstimate{up: true, known: true, expected: 30 * time.Millisecond}
+	slow := arTierEstimate{up: true, known: true, expected: 60 * time.Millisecond}
+	over := arTierEstimate{up: true, known: true, expected: 150 * time.Millisecond}
+
+	tests := []struct {
+		policy      string
+		local, edge arTierEstimate
+		want        string
+	}{
+		{"pool", over, over, arDecisionAny},
+		{"pool", down, fast, arDecisionAny},
+
+		{"local_first", slow, fast, arTierLocal},
+		{"local_first", over, fast, arTierEdge},
+		{"local_first", down, fast, arTierEdge},
+		{"local_first", unmeasured, fast, arTierLocal},
+		{"local_first", over, over, arDecisionSkip},
+		{"local_first", over, down, arDecisionSkip},
+
+		{"edge_first", fast, slow, arTierEdge},
+		{"edge_first", fast, over, arTierLocal},
+		{"edge_first", fast, down, arTierLocal},
+		{"edge_first", fast, unmeasured, arTierEdge},
+		{"edge_first", down, over, arDecisionSkip},
+
+		{"fastest", slow, fast, arTierEdge},
+		{"fastest", fast, slow, arTierLocal},
+		{"fastest", fast, fast, arTierLocal},
+		{"fastest", over, slow, arTierEdge},
+		{"fastest", slow, over, arTierLocal},
+		{"fastest", down, unmeasured, arTierEdge},
+		{"fastest", unmeasured, fast, arTierLocal},
+		{"fastest", over, over, arDecisionSkip},
+		{"fastest", over, down, arDecisionSkip},
+	}
+	for _, test := range tests {
+		if got := arPolicies[test.policy](test.local, test.edge, budget); got != test.want {
+			t.Errorf("%s with local %s, edge %s: got %s, expected %s", test.policy, test.local, test.edge, got, test.want)
+		}
+	}
+}
+
+func TestNewARSchedulerUnknownPolicy(t *testing.T) {
+	if _, err := newARScheduler(ARConfig{Policy: "cheapest"}); err == nil {
+		t.Fatal("created a scheduler with an unknown policy")
+	}
+	for name := range arPolicies {
+		if _, err := newARScheduler(ARConfig{Policy: name}); err != nil {
+			t.Errorf("creating a scheduler with policy %s failed: %v", name, err)
+		}
+	}
+}
+
+// testAREndpoint returns a connected endpoint with the frames in flight and, when latency
+// is not 0, a measured round trip
+func testAREndpoint(address, tier string, inFlight int32, latency time.Duration) *arEndpoint {
+	endpoint := &arEndpoint{address: address, tier: tier, conn: &arConn{}, lastSentAt: time.Now()}
+	endpoint.conn.inFlight.Store(inFlight)
+	if latency > 0 {
+		endpoint.latency.add(latency)
+	}
+	return endpoint
+}
+
+func TestARSchedulerEstimate(t *testing.T) {
+	endpoints := []*arEndpoint{
+		testAREndpoint("local-a", arTierLocal, 2, 20*time.Millisecond),
+		testAREndpoint("local-b", arTierLocal, 0, 50*time.Millisecond),
+		testAREndpoint("edge-a", arTierEdge, 0, 0),
+		{address: "edge-down", tier: arTierEdge},
+	}
+	s := &arScheduler{}
+
+	// local-a expects 3 x 20ms behind its frames in flight, local-b 50ms
+	if local := s.estimate(endpoints, arTierLocal); !local.up || !local.known || local.expected != 50*time.Millisecond {
+		t.Errorf("local estimate %s, expected 50ms", local)
+	}
+	if edge := s.estimate(endpoints, arTierEdge); !edge.up || edge.known {
+		t.Errorf("edge estimate %s, expected not measured", edge)
+	}
+	if edge := s.estimate(endpoints[3:], arTierEdge); edge.up {
+		t.Errorf("edge estimate %s, expected down", edge)
+	}
+}
+
+func TestARSchedulerDecide(t *testing.T) {
+	local := testAREndpoint("local", arTierLocal, 0, 20*time.Millisecond)
+	full := testAREndpoint("local-full", arTierLocal, 1, 20*time.Millisecond)
+	edge := testAREndpoint("edge", arTierEdge, 0, 40*time.Millisecond)
+	endpoints := []*arEndpoint{local, full, edge}
+
+	s, err := newARScheduler(ARConfig{Policy: "local_first", LatencyBudget: 100 * time.Millisecond, MaxInFlight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, candidates := s.decide(endpoints, s.estimate(endpoints, arTierLocal), s.estimate(endpoints, arTierEdge))
+	if decision != arTierLocal || !slices.Equal(candidates, []*arEndpoint{local}) {
+		t.Errorf("decided %s for %d endpoints, expected local only", decision, len(candidates))
+	}
+
+	// An endpoint without frames for a while is probed, unless frames are pooled
+	edge.lastSentAt = time.Now().Add(-2 * arProbeInterval)
+	decision, candidates = s.decide(endpoints, s.estimate(endpoints, arTierLocal), s.estimate(endpoints, arTierEdge))
+	if decision != arDecisionProbe || !slices.Equal(candidates, []*arEndpoint{edge}) {
+		t.Errorf("decided %s for %d endpoints, expected a probe of the edge", decision, len(candidates))
+	}
+	s.policyName, s.policy = "pool", arPolicies["pool"]
+	decision, candidates = s.decide(endpoints, s.estimate(endpoints, arTierLocal), s.estimate(endpoints, arTierEdge))
+	if decision != arDecisionAny || !slices.Equal(candidates, []*arEndpoint{local, edge}) {
+		t.Errorf("decided %s for %d endpoints, expected the endpoints with room", decision, len(candidates))
+	}
+}
@@ -0,0 +1,456 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// opusSampleRate is the sample rate of Opus in RTP, whatever the input rate
+const opusSampleRate = 48000
+
+// opusCapability describes the outgoing audio track
+var opusCapability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   opusSampleRate,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+// delayedSample is an encoded audio packet waiting for the video delay to pass
+type delayedSample struct {
+	sample    media.Sample
+	decodedAt time.Time
+}
+
+// AudioProcessor decodes audio, either from the video input or from its own input,
+// resamples it to 48 kHz stereo, encodes it to Opus and writes it to the audio track,
+// held back by the delay of the video processing
+type AudioProcessor struct {
+	config AudioConfig
+	track  *webrtc.TrackLocalStaticSample
+
+	// Only set when the audio has its own input
+	inputFormatContext *astiav.FormatContext
+	inputPacket        *astiav.Packet
+	pacer              *framePacer
+	// packets holds the audio packets of the video input, when the audio comes from it,
+	// and failed stops taking them once the audio could not be encoded
+	packets chan *astiav.Packet
+	failed  atomic.Bool
+
+	stream             *astiav.Stream
+	decodeCodecContext *astiav.CodecContext
+	decodeFrame        *astiav.Frame
+
+	// Resamples, converts and cuts the decoded audio into encoder sized frames. channelLayout
+	// is the layout of the decoded audio, the default one for its channel count when the
+	// input does not tell.
+	channelLayout     astiav.ChannelLayout
+	filterGraph       *astiav.FilterGraph
+	buffersrcContext  *astiav.BuffersrcFilterContext
+	buffersinkContext *astiav.BuffersinkFilterContext
+	filterFrame       *astiav.Frame
+
+	encodeCodecContext *astiav.CodecContext
+	encodePacket       *astiav.Packet
+	// nextPts counts the samples handed to the encoder
+	nextPts int64
+
+	// samples holds the encoded audio waiting for the video delay, up to a few seconds
+	samples chan delayedSample
+}
+
+// NewAudioProcessor opens the audio input configured in config. stream is the audio
+// stream of the video input, used when no separate audio input is configured.
+func NewAudioProcessor(config AudioConfig, track *webrtc.TrackLocalStaticSample, stream *astiav.Stream) (*AudioProcessor, error) {
+	ap := &AudioProcessor{config: config, track: track, stream: stream, samples: make(chan delayedSample, 256)}
+
+	if config.URL != "" {
+		if err := ap.openInput(); err != nil {
+			return nil, err
+		}
+	}
+	if ap.stream == nil {
+		return nil, errors.New("no audio stream found")
+	}
+	if ap.inputFormatContext == nil {
+		ap.packets = make(chan *astiav.Packet, 64)
+	}
+	if err := ap.initDecoding(); err != nil {
+		return nil, err
+	}
+	if err := ap.initEncoding(); err != nil {
+		return nil, err
+	}
+	if err := ap.initFilters(); err != nil {
+		return nil, err
+	}
+
+	go ap.writeSamples()
+	return ap, nil
+}
+
+func (ap *AudioProcessor) openInput() error {
+	if ap.inputFormatContext = astiav.AllocFormatContext(); ap.inputFormatContext == nil {
+		return errors.New("Failed to AllocFormatContext")
+	}
+
+	var inputFormat *astiav.InputFormat
+	if ap.config.Format != "" {
+		if inputFormat = astiav.FindInputFormat(ap.config.Format); inputFormat == nil {
+			return fmt.Errorf("unknown audio input format %q", ap.config.Format)
+		}
+	}
+
+	inputOptions, err := ap.config.Options.dictionary()
+	if err != nil {
+		return err
+	}
+	if inputOptions != nil {
+		defer inputOptions.Free()
+	}
+
+	if err := ap.inputFormatContext.OpenInput(ap.config.URL, inputFormat, inputOptions); err != nil {
+		return fmt.Errorf("opening audio input %s failed: %w", ap.config.URL, err)
+	}
+	if err := ap.inputFormatContext.FindStreamInfo(nil); err != nil {
+		return err
+	}
+
+	for _, stream := range ap.inputFormatContext.Streams() {
+		if stream.CodecParameters().MediaType() == astiav.MediaTypeAudio {
+			ap.stream = stream
+			break
+		}
+	}
+	ap.inputPacket = astiav.AllocPacket()
+	return nil
+}
+
+func (ap *AudioProcessor) initDecoding() error {
+	decoder := astiav.FindDecoder(ap.stream.CodecParameters().CodecID())
+	if decoder == nil {
+		return errors.New("FindDecoder returned nil for audio")
+	}
+	if ap.decodeCodecContext = astiav.AllocCodecContext(decoder); ap.decodeCodecContext == nil {
+		return errors.New("Failed to allocate context for audio decoder")
+	}
+	if err := ap.stream.CodecParameters().ToCodecContext(ap.decodeCodecContext); err != nil {
+		return err
+	}
+	ap.decodeCodecContext.SetTimeBase(ap.stream.TimeBase())
+	if err := ap.decodeCodecContext.Open(decoder, nil); err != nil {
+		return err
+	}
+
+	ap.pacer = newFramePacer(ap.stream.TimeBase(), astiav.NewRational(0, 1))
+	ap.decodeFrame = astiav.AllocFrame()
+	return nil
+}
+
+func (ap *AudioProcessor) initEncoding() error {
+	encoder := astiav.FindEncoderByName("libopus")
+	if encoder == nil {
+		return errors.New("no libopus encoder found")
+	}
+	if ap.encodeCodecContext = astiav.AllocCodecContext(encoder); ap.encodeCodecContext == nil {
+		return errors.New("Failed to AllocCodecContext for libopus")
+	}
+
+	sampleFormat := astiav.SampleFormatS16
+	if formats := encoder.SampleFormats(); len(formats) > 0 {
+		sampleFormat = formats[0]
+	}
+	ap.encodeCodecContext.SetSampleFormat(sampleFormat)
+	ap.encodeCodecContext.SetSampleRate(opusSampleRate)
+	ap.encodeCodecContext.SetChannelLayout(astiav.ChannelLayoutStereo)
+	ap.encodeCodecContext.SetTimeBase(astiav.NewRational(1, opusSampleRate))
+	ap.encodeCodecContext.SetBitRate(int64(ap.config.Bitrate) * 1000)
+
+	options, err := Options{"application": "voip"}.dictionary()
+	if err != nil {
+		return err
+	}
+	defer options.Free()
+
+	if err := ap.encodeCodecContext.Open(encoder, options); err != nil {
+		return err
+	}
+	fmt.Printf("Opened opus encoder %s at %d kbit/s, %d samples per frame\n", encoder.Name(), ap.config.Bitrate, ap.encodeCodecContext.FrameSize())
+
+	ap.encodePacket = astiav.AllocPacket()
+	return nil
+}
+
+// initFilters builds the graph converting decoded audio to the encoder sample rate,
+// format and layout, in frames of the encoder frame size
+func (ap *AudioProcessor) initFilters() error {
+	if ap.filterGraph = astiav.AllocFilterGraph(); ap.filterGraph == nil {
+		return errors.New("audio filtergraph could not be created")
+	}
+
+	outputs := astiav.AllocFilterInOut()
+	if outputs == nil {
+		return errors.New("audio filter outputs is nil")
+	}
+	defer outputs.Free()
+
+	inputs := astiav.AllocFilterInOut()
+	if inputs == nil {
+		return errors.New("audio filter inputs is nil")
+	}
+	defer inputs.Free()
+
+	buffersrc := astiav.FindFilterByName("abuffer")
+	buffersink := astiav.FindFilterByName("abuffersink")
+	if buffersrc == nil || buffersink == nil {
+		return errors.New("abuffer or abuffersink filter not found")
+	}
+
+	var err error
+	if ap.channelLayout, err = inputChannelLayout(ap.decodeCodecContext.ChannelLayout()); err != nil {
+		return err
+	}
+	if ap.buffersrcContext, err = ap.filterGraph.NewBuffersrcFilterContext(
+		buffersrc,
+		"in",
+		astiav.FilterArgs{
+			"channel_layout": ap.channelLayout.String(),
+			"sample_fmt":     ap.decodeCodecContext.SampleFormat().Name(),
+			"sample_rate":    strconv.Itoa(ap.decodeCodecContext.SampleRate()),
+			"time_base":      ap.decodeCodecContext.TimeBase().String(),
+		}); err != nil {
+		return fmt.Errorf("creating audio buffersrc context failed: %w", err)
+	}
+	if ap.buffersinkContext, err = ap.filterGraph.NewBuffersinkFilterContext(buffersink, "out", nil); err != nil {
+		return fmt.Errorf("creating audio buffersink context failed: %w", err)
+	}
+
+	outputs.SetName("in")
+	outputs.SetFilterContext(ap.buffersrcContext.FilterContext())
+	outputs.SetPadIdx(0)
+	outputs.SetNext(nil)
+
+	inputs.SetName("out")
+	inputs.SetFilterContext(ap.buffersinkContext.FilterContext())
+	inputs.SetPadIdx(0)
+	inputs.SetNext(nil)
+
+	frameSize := ap.encodeCodecContext.FrameSize()
+	if frameSize <= 0 {
+		frameSize = opusSampleRate / 50
+	}
+	graph := fmt.Sprintf("aresample=%d,aformat=sample_fmts=%s:channel_layouts=stereo,asetnsamples=n=%d:p=1",
+		opusSampleRate, ap.encodeCodecContext.SampleFormat().Name(), frameSize)
+	if err := ap.filterGraph.Parse(graph, inputs, outputs); err != nil {
+		return fmt.Errorf("parsing audio filter %q failed: %w", graph, err)
+	}
+	if err := ap.filterGraph.Configure(); err != nil {
+		return fmt.Errorf("configuring audio filter failed: %w", err)
+	}
+
+	ap.filterFrame = astiav.AllocFrame()
+	return nil
+}
+
+// inputChannelLayout returns the layout of decoded audio, or the default layout for its
+// channel count when only the count is known, as with raw audio and capture devices
+func inputChannelLayout(layout astiav.ChannelLayout) (astiav.ChannelLayout, error) {
+	if layout.Valid() && layout.String() != "" {
+		return layout, nil
+	}
+	switch layout.Channels() {
+	case 1:
+		return astiav.ChannelLayoutMono, nil
+	case 2:
+		return astiav.ChannelLayoutStereo, nil
+	case 3:
+		return astiav.ChannelLayout2Point1, nil
+	case 4:
+		return astiav.ChannelLayout4Point0, nil
+	case 5:
+		return astiav.ChannelLayout5Point0Back, nil
+	case 6:
+		return astiav.ChannelLayout5Point1Back, nil
+	case 7:
+		return astiav.ChannelLayout6Point1, nil
+	case 8:
+		return astiav.ChannelLayout7Point1, nil
+	}
+	return astiav.ChannelLayout{}, fmt.Errorf("no channel layout for %d audio channels", layout.Channels())
+}
+
+// run reads and encodes a separate audio input in real time until it ends
+func (ap *AudioProcessor) run() {
+	defer ap.free()
+	for {
+		ap.inputPacket.Unref()
+		if err := ap.inputFormatContext.ReadFrame(ap.inputPacket); err != nil {
+			if !errors.Is(err, astiav.ErrEof) {
+				fmt.Println("Failed to read audio: ", err)
+			}
+			return
+		}
+		if ap.inputPacket.StreamIndex() != ap.stream.Index() {
+			continue
+		}
+		ap.pacer.wait(ap.inputPacket.Pts())
+		if err := ap.handlePacket(ap.inputPacket); err != nil {
+			fmt.Println("Failed to encode audio: ", err)
+			return
+		}
+	}
+}
+
+// decodePackets decodes the audio packets handed over by the video reader in real time,
+// until stop is called. Packets are paced on their own timestamps here, so that they are
+// stamped when they are due like the video frames, whatever the video pacing.
+func (ap *AudioProcessor) decodePackets() {
+	defer ap.free()
+	for packet := range ap.packets {
+		if !ap.failed.Load() {
+			ap.pacer.wait(packet.Pts())
+			if err := ap.handlePacket(packet); err != nil {
+				fmt.Println("Failed to encode audio, dropping the audio track: ", err)
+				ap.failed.Store(true)
+			}
+		}
+		packet.Free()
+	}
+}
+
+// queuePacket hands a packet of the video input over to decodePackets. It never holds the
+// video reader back, a packet that does not fit in the queue is dropped.
+func (ap *AudioProcessor) queuePacket(packet *astiav.Packet) {
+	if ap.failed.Load() {
+		return
+	}
+	select {
+	case ap.packets <- packet.Clone():
+	default:
+		stats.droppedAudioSamples.Add(1)
+	}
+}
+
+// stop ends decodePackets once the packets queued are decoded
+func (ap *AudioProcessor) stop() {
+	close(ap.packets)
+}
+
+// handlePacket decodes an audio packet, in the stream time base, and encodes the result
+func (ap *AudioProcessor) handlePacket(packet *astiav.Packet) error {
+	decodedAt := time.Now()
+	if err := ap.decodeCodecContext.SendPacket(packet); err != nil {
+		// Corrupt audio is not worth stopping the stream for
+		fmt.Println("Failed to decode audio packet: ", err)
+		return nil
+	}
+
+	for {
+		if err := ap.decodeCodecContext.ReceiveFrame(ap.decodeFrame); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return err
+		}
+
+		// Frames without a layout get the one the filters were configured with
+		if layout := ap.decodeFrame.ChannelLayout(); !layout.Valid() || layout.String() == "" {
+			ap.decodeFrame.SetChannelLayout(ap.channelLayout)
+		}
+		if err := ap.buffersrcContext.AddFrame(ap.decodeFrame, astiav.NewBuffersrcFlags(astiav.BuffersrcFlagKeepRef)); err != nil {
+			return fmt.Errorf("adding audio frame failed: %w", err)
+		}
+		ap.decodeFrame.Unref()
+
+		for {
+			ap.filterFrame.Unref()
+			if err := ap.buffersinkContext.GetFrame(ap.filterFrame, astiav.NewBuffersinkFlags()); err != nil {
+				if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+					break
+				}
+				return err
+			}
+			if err := ap.encode(ap.filterFrame, decodedAt); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// encode encodes a converted frame and queues the packets for writing. Timestamps are
+// counted in samples, the track only needs the duration of each packet.
+func (ap *AudioProcessor) encode(frame *astiav.Frame, decodedAt time.Time) error {
+	frame.SetPts(ap.nextPts)
+	ap.nextPts += int64(frame.NbSamples())
+
+	if err := ap.encodeCodecContext.SendFrame(frame); err != nil {
+		return err
+	}
+	for {
+		ap.encodePacket.Unref()
+		if err := ap.encodeCodecContext.ReceivePacket(ap.encodePacket); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return err
+		}
+
+		duration := time.Duration(astiav.RescaleQ(ap.encodePacket.Duration(), ap.encodeCodecContext.TimeBase(), astiav.NewRational(1, int(time.Second))))
+		if duration <= 0 {
+			duration = 20 * time.Millisecond
+		}
+		// Never hold back the decoding, which paces the audio: audio that does not fit in
+		// the queue while a long delay is waited out is dropped
+		select {
+		case ap.samples <- delayedSample{sample: media.Sample{Data: ap.encodePacket.Data(), Duration: duration}, decodedAt: decodedAt}:
+		default:
+			stats.droppedAudioSamples.Add(1)
+		}
+	}
+}
+
+// delay returns how long audio is held back to stay in sync with the processed video
+func (ap *AudioProcessor) delay() time.Duration {
+	if ap.config.LipSync {
+		return ap.config.Delay + stats.videoLatency.get()
+	}
+	return ap.config.Delay
+}
+
+// writeSamples writes the encoded audio to the track once the video delay has passed
+func (ap *AudioProcessor) writeSamples() {
+	for s := range ap.samples {
+		if wait := time.Until(s.decodedAt.Add(ap.delay())); wait > 0 {
+			time.Sleep(wait)
+		}
+		if err := ap.track.WriteSample(s.sample); err != nil {
+			fmt.Println("Failed to write audio sample: ", err)
+			continue
+		}
+		stats.audioDelay.add(time.Since(s.decodedAt))
+		stats.audioSamples.Add(1)
+	}
+}
+
+func (ap *AudioProcessor) free() {
+	close(ap.samples)
+	if ap.inputFormatContext != nil {
+		ap.inputFormatContext.CloseInput()
+		ap.inputFormatContext.Free()
+		ap.inputPacket.Free()
+	}
+	ap.decodeCodecContext.Free()
+	ap.decodeFrame.Free()
+	ap.filterFrame.Free()
+	ap.filterGraph.Free()
+	ap.encodeCodecContext.Free()
+	ap.encodePacket.Free()
+}
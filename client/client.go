@@ -7,7 +7,39 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func Run(generate_stats bool) {
+var (
+    clientConfig Config
+)
+
+func Run(config Config) {
+    // The estimate drives a bitrate based rate control, starting from the initial estimate
+    if config.Congestion.Enabled && config.Encoder.Bitrate == 0 {
+        config.Encoder.Bitrate = config.Congestion.InitialBitrate
+    }
+    if err := config.Validate(); err != nil {
+        log.Fatal("Invalid configuration: ", err)
+    }
+    clientConfig = config
+
+    // Publishers only offer the codecs this machine can actually encode
+    var err error
+    if config.Role.publishes() {
+        localVideoCodecs, err = encodableVideoCodecs(config.Codecs)
+    } else {
+        localVideoCodecs, err = resolveVideoCodecs(config.Codecs)
+    }
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    feedback, err := parseRTCPFeedback(config.RTCPFeedback)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if webrtcAPI, err = newWebRTCAPI(localVideoCodecs, feedback, config.Receiver, config.Congestion); err != nil {
+        log.Fatal("Failed to set up the media engine: ", err)
+    }
+
     // Connect to the WebSocket server
     url := "ws://localhost:8080/ws"
     conn, _, err := websocket.DefaultDialer.Dial(url, nil)
@@ -50,7 +82,7 @@ func Run(generate_stats bool) {
     <-connectionEstablishedChan
     fmt.Println("Successfully established a WebRTC connection between clients")
 
-    openCameraFeed(userPeerConnection, userVideoTrack, generate_stats)
+    openCameraFeed(userPeerConnection, userVideoTracks, userAudioTrack, config.GenerateStats)
 
 	select {}
 }
\ No newline at end of file
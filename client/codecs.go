@@ -0,0 +1,186 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asticode/go-astiav"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// videoEncoderImpl is an FFmpeg encoder able to produce a codec, with the options
+// that make it suitable for real-time use
+type videoEncoderImpl struct {
+	name    string
+	options Options
+}
+
+// videoCodec describes an outgoing video codec, how it is named in SDP and which
+// encoders can produce it, in order of preference
+type videoCodec struct {
+	name        string
+	mimeType    string
+	payloadType webrtc.PayloadType
+	sdpFmtpLine string
+	encoders    []videoEncoderImpl
+	// codecID finds any other encoder of the codec when none of the above is available.
+	// Codecs astiav has no constant for take the ID of the first of decoderNames found.
+	codecID      astiav.CodecID
+	decoderNames []string
+}
+
+var videoCodecs = []videoCodec{
+	{
+		name:        "h264",
+		mimeType:    webrtc.MimeTypeH264,
+		payloadType: 102,
+		encoders:    []videoEncoderImpl{{name: "libx264", options: Options{"forced-idr": "1"}}, {name: "libopenh264"}},
+		codecID:     astiav.CodecIDH264,
+	},
+	{
+		name:        "vp8",
+		mimeType:    webrtc.MimeTypeVP8,
+		payloadType: 96,
+		encoders: []videoEncoderImpl{
+			{name: "libvpx", options: Options{"deadline": "realtime", "cpu-used": "8", "lag-in-frames": "0"}},
+		},
+		codecID: astiav.CodecIDVp8,
+	},
+	{
+		name:        "vp9",
+		mimeType:    webrtc.MimeTypeVP9,
+		payloadType: 98,
+		sdpFmtpLine: "profile-id=0",
+		encoders: []videoEncoderImpl{
+			{name: "libvpx-vp9", options: Options{"deadline": "realtime", "cpu-used": "8", "lag-in-frames": "0", "row-mt": "1"}},
+		},
+		codecID: astiav.CodecIDVp9,
+	},
+	{
+		name:        "av1",
+		mimeType:    webrtc.MimeTypeAV1,
+		payloadType: 45,
+		encoders: []videoEncoderImpl{
+			{name: "libsvtav1", options: Options{"preset": "12"}},
+			{name: "libaom-av1", options: Options{"usage": "realtime", "cpu-used": "8", "lag-in-frames": "0"}},
+			{name: "librav1e", options: Options{"speed": "10"}},
+		},
+		codecID:      astiav.CodecIDNone,
+		decoderNames: []string{"av1", "libdav1d", "libaom-av1"},
+	},
+}
+
+func findVideoCodec(name string) (videoCodec, error) {
+	for _, codec := range videoCodecs {
+		if codec.name == strings.ToLower(name) {
+			return codec, nil
+		}
+	}
+	return videoCodec{}, fmt.Errorf("unknown codec %q, expected h264, vp8, vp9 or av1", name)
+}
+
+// findEncoder returns the preferred encoder available in the linked FFmpeg, with its
+// default options, or nil when the codec cannot be encoded
+func (c videoCodec) findEncoder() (*astiav.Codec, Options) {
+	for _, impl := range c.encoders {
+		if encoder := astiav.FindEncoderByName(impl.name); encoder != nil {
+			return encoder, impl.options
+		}
+	}
+	if id := c.id(); id != astiav.CodecIDNone {
+		if encoder := astiav.FindEncoder(id); encoder != nil {
+			return encoder, nil
+		}
+	}
+	return nil, nil
+}
+
+// id returns the FFmpeg codec ID, CodecIDNone when the linked FFmpeg does not know the codec
+func (c videoCodec) id() astiav.CodecID {
+	if c.codecID != astiav.CodecIDNone {
+		return c.codecID
+	}
+	for _, name := range c.decoderNames {
+		if decoder := astiav.FindDecoderByName(name); decoder != nil {
+			return decoder.ID()
+		}
+	}
+	return astiav.CodecIDNone
+}
+
+// capability returns the RTP codec capability of tracks carrying the codec
+func (c videoCodec) capability(encoder EncoderConfig) webrtc.RTPCodecCapability {
+	capability := webrtc.RTPCodecCapability{MimeType: c.mimeType, ClockRate: 90000, SDPFmtpLine: c.sdpFmtpLine}
+	if c.name == "h264" {
+		capability.SDPFmtpLine = encoder.sdpFmtpLine()
+	}
+	return capability
+}
+
+// resolveVideoCodecs looks up the codecs of a preference list
+func resolveVideoCodecs(names []string) ([]videoCodec, error) {
+	codecs := make([]videoCodec, 0, len(names))
+	for _, name := range names {
+		codec, err := findVideoCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs, nil
+}
+
+// encodableVideoCodecs resolves the codec preference list, dropping the codecs that the
+// linked FFmpeg has no encoder for
+func encodableVideoCodecs(names []string) ([]videoCodec, error) {
+	resolved, err := resolveVideoCodecs(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var codecs []videoCodec
+	for _, codec := range resolved {
+		if encoder, _ := codec.findEncoder(); encoder == nil {
+			fmt.Printf("No encoder available for %s, not offering it\n", codec.name)
+			continue
+		}
+		codecs = append(codecs, codec)
+	}
+	if len(codecs) == 0 {
+		return nil, fmt.Errorf("none of the codecs %s can be encoded", strings.Join(names, ","))
+	}
+	return codecs, nil
+}
+
+// negotiateVideoCodec picks the first codec of the preference list that the remote
+// session description supports for video
+func negotiateVideoCodec(description string, preferences []videoCodec) (videoCodec, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(description)); err != nil {
+		return videoCodec{}, fmt.Errorf("failed to parse remote description: %w", err)
+	}
+
+	remoteMimeTypes := map[string]bool{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.Key != "rtpmap" {
+				continue
+			}
+			// a=rtpmap:<payload type> <encoding name>/<clock rate>
+			_, encoding, _ := strings.Cut(attribute.Value, " ")
+			encodingName, _, _ := strings.Cut(encoding, "/")
+			remoteMimeTypes[strings.ToLower("video/"+encodingName)] = true
+		}
+	}
+
+	for _, codec := range preferences {
+		if remoteMimeTypes[strings.ToLower(codec.mimeType)] {
+			return codec, nil
+		}
+	}
+	return videoCodec{}, fmt.Errorf("remote peer supports none of the preferred codecs")
+}
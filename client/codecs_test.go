@@ -0,0 +1,99 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+// remoteDescription returns a session description with a video and an audio section
+// offering the given rtpmap encodings
+func remoteDescription(videoEncodings, audioEncodings []string) string {
+	lines := []string{"v=0", "o=- 0 0 IN IP4 127.0.0.1", "s=-", "t=0 0", "m=video 9 UDP/TLS/RTP/SAVPF 96"}
+	for _, encoding := range videoEncodings {
+		lines = append(lines, "a=rtpmap:96 "+encoding)
+	}
+	lines = append(lines, "m=audio 9 UDP/TLS/RTP/SAVPF 111")
+	for _, encoding := range audioEncodings {
+		lines = append(lines, "a=rtpmap:111 "+encoding)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func TestNegotiateVideoCodec(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		preferences []string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "first preference supported",
+			description: remoteDescription([]string{"VP8/90000", "H264/90000"}, nil),
+			preferences: []string{"h264", "vp8"},
+			want:        "h264",
+		},
+		{
+			name:        "falls back to a later preference",
+			description: remoteDescription([]string{"VP8/90000"}, nil),
+			preferences: []string{"av1", "vp9", "vp8"},
+			want:        "vp8",
+		},
+		{
+			name:        "encoding names are case insensitive",
+			description: remoteDescription([]string{"vp9/90000"}, nil),
+			preferences: []string{"vp9"},
+			want:        "vp9",
+		},
+		{
+			name:        "audio sections are ignored",
+			description: remoteDescription([]string{"VP8/90000"}, []string{"H264/90000"}),
+			preferences: []string{"h264"},
+			wantErr:     true,
+		},
+		{
+			name:        "no common codec",
+			description: remoteDescription([]string{"H264/90000"}, nil),
+			preferences: []string{"vp8", "av1"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid description",
+			description: "not a session description",
+			preferences: []string{"h264"},
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			preferences, err := resolveVideoCodecs(test.preferences)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codec, err := negotiateVideoCodec(test.description, preferences)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("negotiated %s, expected an error", codec.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.name != test.want {
+				t.Errorf("negotiated %s, expected %s", codec.name, test.want)
+			}
+		})
+	}
+}
+
+func TestFindVideoCodec(t *testing.T) {
+	for _, name := range []string{"h264", "VP8", "vp9", "av1"} {
+		if _, err := findVideoCodec(name); err != nil {
+			t.Errorf("findVideoCodec(%q): %v", name, err)
+		}
+	}
+	if _, err := findVideoCodec("mpeg2"); err == nil {
+		t.Error("findVideoCodec(\"mpeg2\") found a codec")
+	}
+}
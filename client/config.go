@@ -0,0 +1,549 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/pion/webrtc/v3"
+)
+
+// Role decides whether a client publishes its camera feed, views the remote
+// feed, or does both.
+type Role string
+
+const (
+	RolePublisher Role = "publisher"
+	RoleViewer    Role = "viewer"
+	RoleBoth      Role = "both"
+)
+
+func ParseRole(s string) (Role, error) {
+	switch role := Role(s); role {
+	case RolePublisher, RoleViewer, RoleBoth:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q, expected publisher, viewer or both", s)
+}
+
+func (r Role) publishes() bool {
+	return r == RolePublisher || r == RoleBoth
+}
+
+func (r Role) views() bool {
+	return r == RoleViewer || r == RoleBoth
+}
+
+// direction returns the transceiver direction advertised in SDP for the role
+func (r Role) direction() webrtc.RTPTransceiverDirection {
+	switch r {
+	case RolePublisher:
+		return webrtc.RTPTransceiverDirectionSendonly
+	case RoleViewer:
+		return webrtc.RTPTransceiverDirectionRecvonly
+	}
+	return webrtc.RTPTransceiverDirectionSendrecv
+}
+
+// Options is a set of key=value pairs handed to FFmpeg as a dictionary.
+// It implements flag.Value so that it can be filled from repeated flags.
+type Options map[string]string
+
+func (o Options) String() string {
+	pairs := make([]string, 0, len(o))
+	for key, value := range o {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (o Options) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid option %q, expected key=value", s)
+	}
+	o[key] = value
+	return nil
+}
+
+// dictionary returns the options as an FFmpeg dictionary, or nil when there are none.
+// The caller owns the returned dictionary and must free it.
+func (o Options) dictionary() (*astiav.Dictionary, error) {
+	if len(o) == 0 {
+		return nil, nil
+	}
+	d := astiav.NewDictionary()
+	for key, value := range o {
+		if err := d.Set(key, value, astiav.NewDictionaryFlags()); err != nil {
+			d.Free()
+			return nil, fmt.Errorf("setting option %s failed: %w", key, err)
+		}
+	}
+	return d, nil
+}
+
+// TestPatternConfig describes the built-in synthetic video source, which needs
+// neither a camera nor an external ffmpeg process
+type TestPatternConfig struct {
+	Enabled bool
+	// Size is the resolution as WIDTHxHEIGHT
+	Size      string
+	FrameRate int
+}
+
+// graph returns the lavfi description of the test pattern. testsrc already burns in
+// a running timestamp; with overlay the frame number and presentation time are drawn
+// as well, which requires an FFmpeg build with drawtext.
+func (t TestPatternConfig) graph(overlay bool) string {
+	graph := fmt.Sprintf("testsrc=size=%s:rate=%d", t.Size, t.FrameRate)
+	if overlay {
+		graph += ",drawtext=text='frame %{n} pts %{pts\\:hms}':x=10:y=h-th-10:fontsize=24:fontcolor=white:box=1:boxcolor=black"
+	}
+	return graph
+}
+
+// InputConfig describes where the video feed is read from
+type InputConfig struct {
+	// URL is anything astiav can open: a network URL, a file, a device or a lavfi graph
+	URL string
+	// Format forces the input format (e.g. v4l2, lavfi, mpegts), it is probed when empty
+	Format string
+	// Options are passed to the demuxer when opening the input
+	Options Options
+	// Loop seeks back to the start of the input on EOF instead of ending the stream
+	Loop bool
+	// FrameCount stops the stream after that many frames, 0 means no limit
+	FrameCount int
+	// TestPattern replaces URL and Format with the built-in test source when enabled
+	TestPattern TestPatternConfig
+}
+
+// AudioConfig describes the optional audio track, encoded to Opus
+type AudioConfig struct {
+	Enabled bool
+	// URL, Format and Options select a separate audio input. When URL is empty the audio
+	// of the video input is used, or a test tone along with the test pattern.
+	URL     string
+	Format  string
+	Options Options
+	// Bitrate of the Opus encoder in kbit/s
+	Bitrate int
+	// Delay holds the audio back by a fixed amount
+	Delay time.Duration
+	// LipSync additionally delays the audio by the measured video processing latency,
+	// which is mostly the AR round trip, so the receiver plays both in sync
+	LipSync bool
+}
+
+// PipelineConfig sets how decoded frames are queued for the filters
+type PipelineConfig struct {
+	// QueueSize is the number of decoded frames that can wait for the filters
+	QueueSize int
+	// DropPolicy applies while the filters fall behind the input
+	DropPolicy DropPolicy
+}
+
+// ARConfig locates the AR service the "ar" filter sends frames to
+type ARConfig struct {
+	// Addresses are the host:port of the local instances of the service, EdgeAddresses those
+	// on edge nodes. Empty addresses are ignored.
+	Addresses     []string
+	EdgeAddresses []string
+	// EdgeSSHTunnel, when set, is the -L forward of an SSH tunnel to the edge node opened
+	// along with the filter, e.g. 5006:127.0.0.1:5005. EdgeSSH is the user@host the tunnel
+	// goes to, reached through the EdgeSSHJump host and with the EdgeSSHIdentity key when
+	// these are set.
+	EdgeSSHTunnel   string
+	EdgeSSH         string
+	EdgeSSHJump     string
+	EdgeSSHIdentity string
+	// Balancer spreads frames over the instances: round_robin or least_latency
+	Balancer string
+	// Format is the payload format asked for in the handshake: rgba, bgr, yuv420p, png or jpeg
+	Format string
+	// JPEGQuality is the quality of the jpeg payload, 1 to 100
+	JPEGQuality int
+	// MaxInFlight is the number of frames sent ahead of the answers, 1 waits for every answer
+	MaxInFlight int
+	// Timeout bounds connecting and the round trip of every frame, the service is
+	// considered down when it is exceeded
+	Timeout time.Duration
+	// Policy decides per frame between the local and edge instances: pool, local_first,
+	// edge_first or fastest. LatencyBudget is the round trip a frame may take.
+	Policy        string
+	LatencyBudget time.Duration
+	// DecisionLog is a CSV file the decisions are written to, none when empty
+	DecisionLog string
+}
+
+// OutputConfig sets the resolutions the video is processed and encoded at, independently
+// of the input. All of them can be changed at runtime with control commands.
+type OutputConfig struct {
+	// ProcessingSize is the resolution frames are scaled to before the AR stage, as
+	// WIDTHxHEIGHT, empty keeps the source resolution
+	ProcessingSize string
+	// Size is the encoded resolution, empty keeps the processing resolution
+	Size string
+	// FrameRate caps the encoded frame rate, 0 keeps the source rate
+	FrameRate int
+}
+
+// parseSize parses a WIDTHxHEIGHT resolution, an empty string giving 0x0
+func parseSize(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	w, h, ok := strings.Cut(s, "x")
+	width, err := strconv.Atoi(w)
+	if !ok || err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q, expected WIDTHxHEIGHT", s)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q, expected WIDTHxHEIGHT", s)
+	}
+	return width, height, nil
+}
+
+// EncoderConfig holds the settings of the outgoing video encoder. Zero values leave
+// the encoder defaults in place.
+type EncoderConfig struct {
+	// Bitrate and MaxBitrate are in kbit/s
+	Bitrate    int
+	MaxBitrate int
+	// RateControl is cbr, vbr or crf
+	RateControl string
+	CRF         int
+	// KeyframeInterval is the maximum GOP length in frames
+	KeyframeInterval int
+	BFrames          int
+	// Profile is baseline, constrained_baseline, main or high, and Level the H.264 level
+	// advertised with it and set on the encoder, e.g. 3.1
+	Profile string
+	Level   string
+	Preset  string
+	Tune    string
+	// Options are passed to the encoder as is and take precedence over the fields above
+	Options Options
+	// KeyframeRequestInterval is the minimum time between keyframes forced by PLI/FIR
+	KeyframeRequestInterval time.Duration
+}
+
+// h264ProfileIDs maps the supported H.264 profiles to the profile and constraint bytes of
+// the profile-level-id advertised in SDP, which ends with the level
+var h264ProfileIDs = map[string]string{
+	"baseline":             "4200",
+	"constrained_baseline": "42e0",
+	"main":                 "4d00",
+	"high":                 "6400",
+}
+
+// h264Level is an H.264 level with the limits of the streams it covers, frame size in
+// macroblocks and macroblock rate per second
+type h264Level struct {
+	idc               int
+	maxFrameSize      int
+	maxMacroblockRate int
+}
+
+// h264Levels are the levels that can be selected on the command line
+var h264Levels = map[string]h264Level{
+	"3.1": {idc: 31, maxFrameSize: 3600, maxMacroblockRate: 108000},
+	"3.2": {idc: 32, maxFrameSize: 5120, maxMacroblockRate: 216000},
+	"4":   {idc: 40, maxFrameSize: 8192, maxMacroblockRate: 245760},
+	"4.1": {idc: 41, maxFrameSize: 8192, maxMacroblockRate: 245760},
+	"4.2": {idc: 42, maxFrameSize: 8704, maxMacroblockRate: 522240},
+	"5":   {idc: 50, maxFrameSize: 22080, maxMacroblockRate: 589824},
+	"5.1": {idc: 51, maxFrameSize: 36864, maxMacroblockRate: 983040},
+	"5.2": {idc: 52, maxFrameSize: 36864, maxMacroblockRate: 2073600},
+}
+
+// fits reports whether frames of the given size, at the given frame rate, stay within the
+// level. A frame rate of 0 only checks the frame size.
+func (l h264Level) fits(width, height int, frameRate float64) bool {
+	macroblocks := ((width + 15) / 16) * ((height + 15) / 16)
+	return macroblocks <= l.maxFrameSize && float64(macroblocks)*frameRate <= float64(l.maxMacroblockRate)
+}
+
+// h264Profiles maps the supported H.264 profiles to the profile set on the codec context.
+// libx264 only knows baseline, which it always produces as constrained baseline.
+var h264Profiles = map[string]astiav.Profile{
+	"baseline":             astiav.ProfileH264Baseline,
+	"constrained_baseline": astiav.ProfileH264Baseline,
+	"main":                 astiav.ProfileH264Main,
+	"high":                 astiav.ProfileH264High,
+}
+
+// codecOptions translates the settings into FFmpeg codec options for the codec, on top
+// of the defaults of its encoder. Preset, tune and the cbr HRD signalling are libx264
+// options and only applied to H.264.
+func (c EncoderConfig) codecOptions(codec videoCodec, defaults Options) (Options, error) {
+	options := Options{}
+	for key, value := range defaults {
+		options[key] = value
+	}
+	isH264 := codec.name == "h264"
+	kbps := func(v int) string { return strconv.Itoa(v * 1000) }
+
+	if c.Bitrate > 0 {
+		options["b"] = kbps(c.Bitrate)
+	}
+
+	switch c.RateControl {
+	case "":
+	case "cbr":
+		if c.Bitrate <= 0 {
+			return nil, errors.New("cbr rate control needs a bitrate")
+		}
+		options["minrate"] = kbps(c.Bitrate)
+		options["maxrate"] = kbps(c.Bitrate)
+		options["bufsize"] = kbps(c.Bitrate)
+		if isH264 {
+			options["nal-hrd"] = "cbr"
+		}
+	case "vbr":
+		if c.Bitrate <= 0 {
+			return nil, errors.New("vbr rate control needs a bitrate")
+		}
+	case "crf":
+		options["crf"] = strconv.Itoa(c.CRF)
+	default:
+		return nil, fmt.Errorf("unknown rate control %q, expected cbr, vbr or crf", c.RateControl)
+	}
+
+	// Cap the rate with a one second buffer, unless cbr already did
+	if c.MaxBitrate > 0 && c.RateControl != "cbr" {
+		options["maxrate"] = kbps(c.MaxBitrate)
+		options["bufsize"] = kbps(c.MaxBitrate)
+	}
+
+	if c.KeyframeInterval > 0 {
+		options["g"] = strconv.Itoa(c.KeyframeInterval)
+	}
+	if c.BFrames >= 0 {
+		options["bf"] = strconv.Itoa(c.BFrames)
+	}
+	if c.Preset != "" && isH264 {
+		options["preset"] = c.Preset
+	}
+	if c.Tune != "" && isH264 {
+		options["tune"] = c.Tune
+	}
+
+	for key, value := range c.Options {
+		options[key] = value
+	}
+	return options, nil
+}
+
+// forShare returns the settings for an encoder producing the given share of the total
+// bitrate, as each simulcast layer does
+func (c EncoderConfig) forShare(share float64) EncoderConfig {
+	c.Bitrate = int(float64(c.Bitrate) * share)
+	c.MaxBitrate = int(float64(c.MaxBitrate) * share)
+	return c
+}
+
+// profile returns the H.264 profile to set on the codec context, if any
+func (c EncoderConfig) profile() (astiav.Profile, bool, error) {
+	if c.Profile == "" {
+		return 0, false, nil
+	}
+	profile, ok := h264Profiles[c.Profile]
+	if !ok {
+		return 0, false, fmt.Errorf("unknown profile %q, expected baseline, constrained_baseline, main or high", c.Profile)
+	}
+	return profile, true, nil
+}
+
+// level returns the H.264 level to advertise and set on the encoder
+func (c EncoderConfig) level() (h264Level, error) {
+	level, ok := h264Levels[c.Level]
+	if !ok {
+		return h264Level{}, fmt.Errorf("unknown H.264 level %q, expected one of 3.1, 3.2, 4, 4.1, 4.2, 5, 5.1 or 5.2", c.Level)
+	}
+	return level, nil
+}
+
+// sdpFmtpLine returns the H.264 fmtp line matching the configured profile and level, so
+// the negotiated profile-level-id describes the stream actually produced
+func (c EncoderConfig) sdpFmtpLine() string {
+	profileID, ok := h264ProfileIDs[c.Profile]
+	level, err := c.level()
+	if !ok || err != nil {
+		return ""
+	}
+	return fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%s%02x", profileID, level.idc)
+}
+
+// ReceiverConfig controls the feedback sent for incoming video
+type ReceiverConfig struct {
+	// ReportInterval is the interval between RTCP receiver reports
+	ReportInterval time.Duration
+	// A PLI is sent when at least PLIGapPackets packets are missing at once,
+	// or no packet arrived for PLIGapTimeout, 0 disables either check
+	PLIGapPackets int
+	PLIGapTimeout time.Duration
+	// PLIInterval is the minimum time between two PLIs
+	PLIInterval time.Duration
+}
+
+// Config holds the client settings collected from the command line
+type Config struct {
+	Role          Role
+	GenerateStats bool
+	Input         InputConfig
+	Audio         AudioConfig
+	Output        OutputConfig
+	Encoder       EncoderConfig
+	// Filters lists the processing stages applied between decoding and encoding, in order
+	Filters []string
+	// FilterGraph is the FFmpeg filtergraph description run by the "ffmpeg" filter
+	FilterGraph string
+	AR          ARConfig
+	Pipeline    PipelineConfig
+	// Codecs lists the outgoing video codecs in order of preference
+	Codecs []string
+	// RTCPFeedback lists the feedback advertised for video, e.g. "nack pli"
+	RTCPFeedback []string
+	Receiver     ReceiverConfig
+	Congestion   CongestionConfig
+	// SimulcastLayers is the number of simulcast encodings published, 1 disables simulcast
+	SimulcastLayers int
+}
+
+// Validate checks the settings that would otherwise only fail once the call is set up
+func (c Config) Validate() error {
+	if len(c.Codecs) == 0 {
+		return errors.New("no video codec configured")
+	}
+	if _, _, err := parseSize(c.Output.ProcessingSize); err != nil {
+		return err
+	}
+	if _, _, err := parseSize(c.Output.Size); err != nil {
+		return err
+	}
+	if c.Output.FrameRate < 0 {
+		return errors.New("output frame rate must not be negative")
+	}
+	if len(c.Filters) == 0 {
+		return errors.New("no filter configured, use passthrough to send frames unprocessed")
+	}
+	for _, name := range c.Filters {
+		if !slices.Contains(frameFilterNames, strings.TrimSpace(name)) {
+			return fmt.Errorf("unknown filter %q, expected one of %s", name, strings.Join(frameFilterNames, ", "))
+		}
+	}
+	if slices.ContainsFunc(c.Filters, func(name string) bool { return strings.TrimSpace(name) == "ar" }) {
+		addresses := slices.Concat(c.AR.Addresses, c.AR.EdgeAddresses)
+		if !slices.ContainsFunc(addresses, func(address string) bool { return strings.TrimSpace(address) != "" }) {
+			return errors.New("no AR service address configured")
+		}
+		if _, ok := arPolicies[c.AR.Policy]; !ok {
+			return fmt.Errorf("unknown AR scheduling policy %q, expected pool, local_first, edge_first or fastest", c.AR.Policy)
+		}
+		if c.AR.LatencyBudget <= 0 {
+			return errors.New("AR latency budget must be positive")
+		}
+		if !slices.Contains(arBalancerNames, c.AR.Balancer) {
+			return fmt.Errorf("unknown AR balancer %q, expected one of %s", c.AR.Balancer, strings.Join(arBalancerNames, ", "))
+		}
+		if _, err := parseARFormat(c.AR.Format); err != nil {
+			return err
+		}
+		if width, height, _ := parseSize(c.Output.ProcessingSize); c.AR.Format == "yuv420p" && (width%2 != 0 || height%2 != 0) {
+			return errors.New("the AR stage size must be even in both dimensions with yuv420p frames")
+		}
+		if c.AR.Format == "jpeg" && (c.AR.JPEGQuality < 1 || c.AR.JPEGQuality > 100) {
+			return errors.New("AR jpeg quality must be between 1 and 100")
+		}
+		if c.AR.MaxInFlight < 1 {
+			return errors.New("at least one frame has to be in flight to the AR service")
+		}
+		if c.AR.Timeout <= 0 {
+			return errors.New("AR timeout must be positive")
+		}
+		if (c.AR.EdgeSSHTunnel == "") != (c.AR.EdgeSSH == "") {
+			return errors.New("an SSH tunnel to the edge node needs both the forward and the destination")
+		}
+	}
+	if slices.ContainsFunc(c.Filters, func(name string) bool { return strings.TrimSpace(name) == "ffmpeg" }) {
+		if err := validateFilterGraph(c.filterGraph()); err != nil {
+			return fmt.Errorf("invalid filtergraph: %w", err)
+		}
+	}
+	if c.Pipeline.QueueSize < 1 {
+		return errors.New("frame queue size must be at least 1")
+	}
+	if _, err := ParseDropPolicy(string(c.Pipeline.DropPolicy)); err != nil {
+		return err
+	}
+	if c.Audio.Enabled && (c.Audio.Bitrate <= 0 || c.Audio.Delay < 0) {
+		return errors.New("audio needs a positive bitrate and a delay of at least 0")
+	}
+	for _, name := range c.Codecs {
+		codec, err := findVideoCodec(name)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Encoder.codecOptions(codec, nil); err != nil {
+			return err
+		}
+	}
+	if _, _, err := c.Encoder.profile(); err != nil {
+		return err
+	}
+	if slices.ContainsFunc(c.Codecs, func(name string) bool {
+		codec, err := findVideoCodec(name)
+		return err == nil && codec.name == "h264"
+	}) {
+		level, err := c.Encoder.level()
+		if err != nil {
+			return err
+		}
+		// The size is only known here when it is configured, the encoders check it again
+		size := c.Output.Size
+		if size == "" {
+			size = c.Output.ProcessingSize
+		}
+		if width, height, _ := parseSize(size); width > 0 && !level.fits(width, height, float64(c.Output.FrameRate)) {
+			return fmt.Errorf("%s exceeds H.264 level %s, lower the output size or frame rate or raise the level", size, c.Encoder.Level)
+		}
+	}
+	feedback, err := parseRTCPFeedback(c.RTCPFeedback)
+	if err != nil {
+		return err
+	}
+	if c.Receiver.ReportInterval <= 0 {
+		return errors.New("receiver report interval must be positive")
+	}
+	if c.Congestion.Enabled {
+		if !hasRTCPFeedback(feedback, webrtc.TypeRTCPFBTransportCC, "") {
+			return errors.New("congestion control needs transport-cc feedback")
+		}
+		if c.Encoder.RateControl == "crf" {
+			return errors.New("congestion control needs a bitrate based rate control")
+		}
+	}
+	if c.SimulcastLayers < 1 || c.SimulcastLayers > len(simulcastLayers) {
+		return fmt.Errorf("simulcast layers must be between 1 and %d", len(simulcastLayers))
+	}
+	if c.SimulcastLayers > 1 && len(c.Codecs) > 1 {
+		return errors.New("simulcast needs a single codec, since the layers cannot switch codec after the offer")
+	}
+	return c.Congestion.validate()
+}
+
+// filterGraph returns the configured filtergraph description, the default one when empty
+func (c Config) filterGraph() string {
+	if c.FilterGraph == "" {
+		return defaultFilterGraph
+	}
+	return c.FilterGraph
+}
@@ -0,0 +1,111 @@
+package client
+
+import "testing"
+
+func TestH264LevelFits(t *testing.T) {
+	tests := []struct {
+		level         string
+		width, height int
+		frameRate     float64
+		want          bool
+	}{
+		{"3.1", 1280, 720, 30, true},
+		{"3.1", 1280, 720, 60, false},
+		{"3.1", 1920, 1080, 0, false},
+		{"3.1", 640, 480, 60, true},
+		{"4.2", 1920, 1080, 60, true},
+		{"4", 1920, 1080, 60, false},
+		{"5.1", 3840, 2160, 30, true},
+	}
+	for _, test := range tests {
+		if got := h264Levels[test.level].fits(test.width, test.height, test.frameRate); got != test.want {
+			t.Errorf("level %s fits %dx%d at %v fps: %v, expected %v", test.level, test.width, test.height, test.frameRate, got, test.want)
+		}
+	}
+}
+
+func TestH264SDPFmtpLine(t *testing.T) {
+	tests := []struct {
+		profile, level string
+		want           string
+	}{
+		{"constrained_baseline", "3.1", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{"high", "4.2", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64002a"},
+		{"main", "5.1", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d0033"},
+		{"", "3.1", ""},
+		{"main", "9", ""},
+	}
+	for _, test := range tests {
+		if got := (EncoderConfig{Profile: test.profile, Level: test.level}).sdpFmtpLine(); got != test.want {
+			t.Errorf("sdpFmtpLine for %q at level %q = %q, expected %q", test.profile, test.level, got, test.want)
+		}
+	}
+}
+
+func TestValidateH264Level(t *testing.T) {
+	config := Config{
+		Codecs:          []string{"h264"},
+		Filters:         []string{"passthrough"},
+		Encoder:         EncoderConfig{Profile: "constrained_baseline", Level: "3.1", BFrames: -1},
+		Pipeline:        PipelineConfig{QueueSize: 1, DropPolicy: DropOldest},
+		Receiver:        ReceiverConfig{ReportInterval: 1},
+		SimulcastLayers: 1,
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("validating the base config failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		size      string
+		frameRate int
+		level     string
+		wantErr   bool
+	}{
+		{name: "size from the source", level: "3.1"},
+		{name: "within the level", size: "1280x720", frameRate: 30, level: "3.1"},
+		{name: "frame too large", size: "1920x1080", level: "3.1", wantErr: true},
+		{name: "frame rate too high", size: "1280x720", frameRate: 60, level: "3.1", wantErr: true},
+		{name: "higher level", size: "1920x1080", frameRate: 60, level: "4.2"},
+		{name: "unknown level", level: "7", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := config
+			c.Output.Size, c.Output.FrameRate, c.Encoder.Level = test.size, test.frameRate, test.level
+			if err := c.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("got error %v, expected an error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateARSize(t *testing.T) {
+	tests := []struct {
+		format  string
+		size    string
+		wantErr bool
+	}{
+		{format: "yuv420p", size: "640x480"},
+		{format: "yuv420p", size: ""},
+		{format: "yuv420p", size: "641x480", wantErr: true},
+		{format: "yuv420p", size: "640x481", wantErr: true},
+		{format: "rgba", size: "641x481"},
+	}
+	for _, test := range tests {
+		config := Config{
+			Codecs:   []string{"vp8"},
+			Filters:  []string{"ar"},
+			AR:       ARConfig{Addresses: []string{"127.0.0.1:5005"}, Balancer: "round_robin", Format: test.format, MaxInFlight: 1, Timeout: 1, Policy: "pool", LatencyBudget: 1},
+			Output:   OutputConfig{ProcessingSize: test.size},
+			Encoder:  EncoderConfig{BFrames: -1},
+			Pipeline: PipelineConfig{QueueSize: 1, DropPolicy: DropOldest},
+			Receiver: ReceiverConfig{ReportInterval: 1},
+
+			SimulcastLayers: 1,
+		}
+		if err := config.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s at %q: got error %v, expected an error: %v", test.format, test.size, err, test.wantErr)
+		}
+	}
+}
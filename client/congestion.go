@@ -0,0 +1,209 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+)
+
+// CongestionConfig controls the send side bandwidth estimation (Google congestion
+// control over transport-cc feedback) that drives the encoder bitrate
+type CongestionConfig struct {
+	Enabled bool
+	// InitialBitrate, MinBitrate and MaxBitrate bound the estimate, in kbit/s
+	InitialBitrate int
+	MinBitrate     int
+	MaxBitrate     int
+	// Tiers downgrade the resolution and frame rate when the estimate drops
+	Tiers []DowngradeTier
+}
+
+// DowngradeTier applies while the bandwidth estimate is below BelowBitrate kbit/s.
+// The tier with the lowest threshold above the estimate wins.
+type DowngradeTier struct {
+	BelowBitrate int
+	// Scale is applied to the source resolution, 0 or 1 keeps it
+	Scale float64
+	// MaxFrameRate caps the encoded frame rate, 0 keeps the source rate
+	MaxFrameRate int
+}
+
+func (t DowngradeTier) String() string {
+	if t.BelowBitrate == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("below %d kbit/s (scale %g, max %d fps)", t.BelowBitrate, t.Scale, t.MaxFrameRate)
+}
+
+// ParseDowngradeTiers parses a comma separated list of kbps:scale:fps tiers,
+// e.g. "800:0.75:0,400:0.5:15"
+func ParseDowngradeTiers(s string) ([]DowngradeTier, error) {
+	var tiers []DowngradeTier
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid downgrade tier %q, expected kbps:scale:fps", entry)
+		}
+		belowBitrate, err := strconv.Atoi(fields[0])
+		if err != nil || belowBitrate <= 0 {
+			return nil, fmt.Errorf("invalid bitrate in downgrade tier %q", entry)
+		}
+		scale, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || scale < 0 || scale > 1 {
+			return nil, fmt.Errorf("invalid scale in downgrade tier %q, expected a value up to 1", entry)
+		}
+		maxFrameRate, err := strconv.Atoi(fields[2])
+		if err != nil || maxFrameRate < 0 {
+			return nil, fmt.Errorf("invalid frame rate in downgrade tier %q", entry)
+		}
+		tiers = append(tiers, DowngradeTier{BelowBitrate: belowBitrate, Scale: scale, MaxFrameRate: maxFrameRate})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].BelowBitrate < tiers[j].BelowBitrate })
+	return tiers, nil
+}
+
+func (c CongestionConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MinBitrate <= 0 || c.InitialBitrate < c.MinBitrate || c.MaxBitrate < c.InitialBitrate {
+		return errors.New("congestion control bitrates must satisfy 0 < min <= initial <= max")
+	}
+	return nil
+}
+
+// tierFor returns the downgrade tier for an estimate in kbit/s, the zero tier when none applies
+func (c CongestionConfig) tierFor(kbps int) DowngradeTier {
+	for _, tier := range c.Tiers {
+		if kbps < tier.BelowBitrate {
+			return tier
+		}
+	}
+	return DowngradeTier{}
+}
+
+// bandwidthEstimatorChan hands the estimator of the peer connection over to the video
+// processor, which is created after the connection is established
+var bandwidthEstimatorChan = make(chan cc.BandwidthEstimator, 1)
+
+// newCongestionController returns the interceptor running the bandwidth estimation
+func newCongestionController(config CongestionConfig) (*cc.InterceptorFactory, error) {
+	controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(config.InitialBitrate*1000),
+			gcc.SendSideBWEMinBitrate(config.MinBitrate*1000),
+			gcc.SendSideBWEMaxBitrate(config.MaxBitrate*1000),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	controller.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		select {
+		case bandwidthEstimatorChan <- estimator:
+		default:
+			fmt.Println("Ignoring bandwidth estimator of additional peer connection", id)
+		}
+	})
+	return controller, nil
+}
+
+// followBandwidthEstimate feeds the target bitrate of the peer connection's bandwidth
+// estimator into the encoder
+func followBandwidthEstimate(vp *VideoProcessor) {
+	var estimator cc.BandwidthEstimator
+	select {
+	case estimator = <-bandwidthEstimatorChan:
+	default:
+		fmt.Println("No bandwidth estimator available, keeping the encoder bitrate fixed")
+		return
+	}
+
+	estimator.OnTargetBitrateChange(func(bitrate int) {
+		vp.SetTargetBitrate(bitrate)
+	})
+	vp.SetTargetBitrate(estimator.GetTargetBitrate())
+}
+
+// SetTargetBitrate sets the bitrate in bit/s the encoder should produce from the next frame on
+func (vp *VideoProcessor) SetTargetBitrate(bitrate int) {
+	if bitrate > 0 {
+		vp.targetBitrate.Store(int64(bitrate))
+	}
+}
+
+// adaptToBandwidth applies the latest target bitrate to the encoders, split between the
+// layers by their share. When the estimate moves into another downgrade tier with a
+// different scale, the encoders are flushed and reopened at the new resolution.
+func (vp *VideoProcessor) adaptToBandwidth(frameDuration time.Duration) error {
+	bitrate := vp.targetBitrate.Load()
+	if bitrate == 0 || bitrate == vp.appliedBitrate {
+		return nil
+	}
+	vp.appliedBitrate = bitrate
+
+	if tier := vp.congestion.tierFor(int(bitrate / 1000)); tier != vp.tier {
+		fmt.Printf("Bandwidth estimate %d kbit/s, switching to downgrade tier %s\n", bitrate/1000, tier)
+		rescale := tier.Scale != vp.tier.Scale
+		vp.tier = tier
+		vp.nextFrameAt = 0
+
+		if rescale {
+			if err := vp.reopenEncoders(frameDuration); err != nil {
+				return err
+			}
+		}
+	}
+
+	// libx264 picks up bitrate changes on the next frame, keep within the configured cap
+	if maxBitrate := int64(vp.encoder.MaxBitrate) * 1000; maxBitrate > 0 && bitrate > maxBitrate {
+		bitrate = maxBitrate
+	}
+	for _, layer := range vp.layers {
+		layer.codecContext.SetBitRate(int64(float64(bitrate) * layer.share))
+	}
+	return nil
+}
+
+// maxFrameRate returns the cap on the encoded frame rate, the lower of the output frame
+// rate and the one of the active downgrade tier, 0 when there is none
+func (vp *VideoProcessor) maxFrameRate() int {
+	maxFrameRate := vp.outputFrameRate
+	if tierRate := vp.tier.MaxFrameRate; tierRate > 0 && (maxFrameRate == 0 || tierRate < maxFrameRate) {
+		maxFrameRate = tierRate
+	}
+	return maxFrameRate
+}
+
+// skipForFrameRate reports whether a frame, whose pts is in timeBase, has to be dropped
+// to stay under the frame rate cap
+func (vp *VideoProcessor) skipForFrameRate(pts int64, timeBase astiav.Rational) bool {
+	maxFrameRate := vp.maxFrameRate()
+	if maxFrameRate <= 0 || pts == astiav.NoPtsValue {
+		return false
+	}
+
+	at := time.Duration(astiav.RescaleQ(pts, timeBase, astiav.NewRational(1, int(time.Second))))
+	if at < vp.nextFrameAt {
+		return true
+	}
+
+	interval := time.Second / time.Duration(maxFrameRate)
+	vp.nextFrameAt += interval
+	if vp.nextFrameAt <= at {
+		// First frame of the tier, or the source paused, start counting from this frame
+		vp.nextFrameAt = at + interval
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseDowngradeTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []DowngradeTier
+		wantErr bool
+	}{
+		{
+			name:  "sorted by threshold",
+			input: "800:0.75:0, 400:0.5:15",
+			want:  []DowngradeTier{{BelowBitrate: 400, Scale: 0.5, MaxFrameRate: 15}, {BelowBitrate: 800, Scale: 0.75}},
+		},
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:  "empty entries",
+			input: "300:1:10,,",
+			want:  []DowngradeTier{{BelowBitrate: 300, Scale: 1, MaxFrameRate: 10}},
+		},
+		{name: "missing field", input: "800:0.75", wantErr: true},
+		{name: "zero bitrate", input: "0:0.5:15", wantErr: true},
+		{name: "bitrate not a number", input: "fast:0.5:15", wantErr: true},
+		{name: "scale above 1", input: "800:1.5:0", wantErr: true},
+		{name: "negative scale", input: "800:-0.5:0", wantErr: true},
+		{name: "negative frame rate", input: "800:0.5:-1", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tiers, err := ParseDowngradeTiers(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %v, expected an error", tiers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(tiers, test.want) {
+				t.Errorf("parsed %v, expected %v", tiers, test.want)
+			}
+		})
+	}
+}
+
+func TestTierFor(t *testing.T) {
+	tiers, err := ParseDowngradeTiers("800:0.75:0,400:0.5:15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := CongestionConfig{Tiers: tiers}
+
+	tests := []struct {
+		kbps int
+		want int
+	}{
+		{1000, 0},
+		{800, 0},
+		{799, 800},
+		{400, 800},
+		{100, 400},
+	}
+	for _, test := range tests {
+		if tier := config.tierFor(test.kbps); tier.BelowBitrate != test.want {
+			t.Errorf("tierFor(%d) = %v, expected the tier below %d kbit/s", test.kbps, tier, test.want)
+		}
+	}
+}
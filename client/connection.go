@@ -1,6 +1,7 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
@@ -10,11 +11,56 @@ import (
 
 var (
 	userPeerConnection      *webrtc.PeerConnection
-	userVideoTrack          *webrtc.TrackLocalStaticSample
+	userVideoTracks         []*webrtc.TrackLocalStaticSample
+	userAudioTrack          *webrtc.TrackLocalStaticSample
+	userVideoCodec          videoCodec
+	localVideoCodecs        []videoCodec
+	webrtcAPI               *webrtc.API
 	connectionEstablishedChan = make(chan bool)
 )
 
-func createPeerConnection(conn *websocket.Conn) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample, error) {
+func newVideoTrack(codec videoCodec) (*webrtc.TrackLocalStaticSample, error) {
+    return webrtc.NewTrackLocalStaticSample(codec.capability(clientConfig.Encoder), "video", "pion")
+}
+
+// newVideoTracks returns the outgoing tracks, a single one or one RID-tagged track per
+// simulcast layer sharing the same track and stream ID
+func newVideoTracks(codec videoCodec) ([]*webrtc.TrackLocalStaticSample, error) {
+    if clientConfig.SimulcastLayers <= 1 {
+        track, err := newVideoTrack(codec)
+        if err != nil {
+            return nil, err
+        }
+        return []*webrtc.TrackLocalStaticSample{track}, nil
+    }
+
+    tracks := make([]*webrtc.TrackLocalStaticSample, 0, clientConfig.SimulcastLayers)
+    for _, layer := range simulcastLayers[:clientConfig.SimulcastLayers] {
+        track, err := webrtc.NewTrackLocalStaticSample(codec.capability(clientConfig.Encoder), "video", "pion", webrtc.WithRTPStreamID(layer.rid))
+        if err != nil {
+            return nil, err
+        }
+        tracks = append(tracks, track)
+    }
+    return tracks, nil
+}
+
+// replaceVideoTrack swaps the outgoing track for one carrying another codec. Simulcast
+// senders cannot replace their tracks, which is why simulcast is limited to one codec.
+func replaceVideoTrack(peerConnection *webrtc.PeerConnection, oldTrack *webrtc.TrackLocalStaticSample, codec videoCodec) (*webrtc.TrackLocalStaticSample, error) {
+    newTrack, err := newVideoTrack(codec)
+    if err != nil {
+        return nil, err
+    }
+    for _, sender := range peerConnection.GetSenders() {
+        if sender.Track() == oldTrack {
+            return newTrack, sender.ReplaceTrack(newTrack)
+        }
+    }
+    return nil, errors.New("no sender found for the video track")
+}
+
+func createPeerConnection(conn *websocket.Conn, codec videoCodec) (*webrtc.PeerConnection, []*webrtc.TrackLocalStaticSample, *webrtc.TrackLocalStaticSample, error) {
     /*
 	Initializes a new WebRTC peer connection
 	*/
@@ -32,9 +78,9 @@ func createPeerConnection(conn *websocket.Conn) (*webrtc.PeerConnection, *webrtc
     }
 
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := webrtcAPI.NewPeerConnection(config)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
     peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
@@ -65,22 +111,67 @@ func createPeerConnection(conn *websocket.Conn) (*webrtc.PeerConnection, *webrtc
 	})
 
 
-    videoTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: "video/h264"}, "video", "pion")
+    // Publishers with audio send it along, sendonly or sendrecv like the video. Anyone else
+    // viewing offers to receive audio so that the remote publisher can add it.
+    var audioTrack *webrtc.TrackLocalStaticSample
+    if clientConfig.Role.publishes() && clientConfig.Audio.Enabled {
+        if audioTrack, err = webrtc.NewTrackLocalStaticSample(opusCapability, "audio", "pion"); err != nil {
+            return nil, nil, nil, err
+        }
+        _, err = peerConnection.AddTransceiverFromTrack(audioTrack, webrtc.RTPTransceiverInit{
+            Direction: clientConfig.Role.direction(),
+        })
+    } else if clientConfig.Role.views() {
+        _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+            Direction: webrtc.RTPTransceiverDirectionRecvonly,
+        })
+    }
     if err != nil {
-        return nil, nil, err
+        return nil, nil, nil, err
     }
 
-    // Add the track to the peer connection
-    _, err = peerConnection.AddTrack(videoTrack)
+    // A viewer only receives, so it offers a recvonly transceiver without a local track
+    if !clientConfig.Role.publishes() {
+        _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+            Direction: clientConfig.Role.direction(),
+        })
+        if err != nil {
+            return nil, nil, nil, err
+        }
+        return peerConnection, nil, nil, nil
+    }
+
+    videoTracks, err := newVideoTracks(codec)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    // Add the track to the peer connection, sendonly for publishers and sendrecv otherwise
+    transceiver, err := peerConnection.AddTransceiverFromTrack(videoTracks[0], webrtc.RTPTransceiverInit{
+        Direction: clientConfig.Role.direction(),
+    })
     if err != nil {
-        return nil, nil, err
+        return nil, nil, nil, err
+    }
+
+    // The other simulcast layers are added as encodings of the same sender
+    for _, track := range videoTracks[1:] {
+        if err = transceiver.Sender().AddEncoding(track); err != nil {
+            return nil, nil, nil, err
+        }
     }
     
-    return peerConnection, videoTrack, nil 
+    return peerConnection, videoTracks, audioTrack, nil 
 }
 
 func establishConnectionWithPeer(conn *websocket.Conn){
-    peerConnection, videoTrack, err := createPeerConnection(conn)
+    // Offer with the most preferred codec, the answer decides which one is used
+    var codec videoCodec
+    if clientConfig.Role.publishes() {
+        codec = localVideoCodecs[0]
+    }
+
+    peerConnection, videoTracks, audioTrack, err := createPeerConnection(conn, codec)
     if err != nil {
         panic(err)
     }
@@ -110,13 +201,30 @@ func establishConnectionWithPeer(conn *websocket.Conn){
         Type: webrtc.SDPTypeAnswer,
         SDP:  answer,
     }
+
+    // Switch to the best codec the remote peer accepted before media starts flowing
+    if videoTracks != nil {
+        negotiatedCodec, err := negotiateVideoCodec(answer, localVideoCodecs)
+        if err != nil {
+            log.Fatal("Failed to negotiate video codec: ", err)
+        }
+        if negotiatedCodec.name != codec.name {
+            if videoTracks[0], err = replaceVideoTrack(peerConnection, videoTracks[0], negotiatedCodec); err != nil {
+                log.Fatal("Failed to switch video codec: ", err)
+            }
+            codec = negotiatedCodec
+        }
+        fmt.Println("Sending video as", codec.name)
+    }
     
     if err := peerConnection.SetRemoteDescription(answerSDP); err != nil {
         log.Fatal("Failed to set remote description: ", err)
     }
 
     userPeerConnection = peerConnection
-    userVideoTrack = videoTrack
+    userVideoTracks = videoTracks
+    userAudioTrack = audioTrack
+    userVideoCodec = codec
     connectionEstablishedChan <- true
 }
 
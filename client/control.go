@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// readControlCommands reads commands changing the video processing at runtime, one per line:
+//
+//	ar_size WIDTHxHEIGHT|source   resolution of the AR stage
+//	size WIDTHxHEIGHT|source      encoded resolution, source follows the AR stage
+//	fps N                         cap on the encoded frame rate, 0 for the source rate
+//	filter GRAPH                  FFmpeg filtergraph of the ffmpeg filter, e.g. hflip,eq=contrast=1.5
+//
+// The peer connection is kept, the encoders are reopened when the resolution changes
+// and the filtergraph is rebuilt between two frames.
+func readControlCommands(r io.Reader, vp *VideoProcessor) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := runControlCommand(line, vp); err != nil {
+			fmt.Println("Invalid control command: ", err)
+		}
+	}
+}
+
+func runControlCommand(line string, vp *VideoProcessor) error {
+	command, argument, _ := strings.Cut(line, " ")
+	argument = strings.TrimSpace(argument)
+
+	switch command {
+	case "ar_size", "size":
+		var width, height int
+		if argument != "source" {
+			var err error
+			if width, height, err = parseSize(argument); err != nil {
+				return err
+			}
+			if width == 0 {
+				return errors.New("missing size")
+			}
+		}
+		if command == "ar_size" {
+			vp.SetProcessingSize(width, height)
+		} else {
+			vp.SetOutputSize(width, height)
+		}
+	case "fps":
+		frameRate, err := strconv.Atoi(argument)
+		if err != nil || frameRate < 0 {
+			return fmt.Errorf("invalid frame rate %q", argument)
+		}
+		vp.SetOutputFrameRate(frameRate)
+	case "filter":
+		if argument == "" {
+			return errors.New("missing filtergraph")
+		}
+		return vp.SetFilterGraph(argument)
+	default:
+		return fmt.Errorf("unknown command %q, expected ar_size, size, fps or filter", command)
+	}
+	return nil
+}
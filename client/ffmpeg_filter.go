@@ -0,0 +1,218 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/asticode/go-astiav"
+)
+
+// defaultFilterGraph raises the brightness with the eq filter and flips the image vertically.
+// It is used when no filtergraph is configured.
+const defaultFilterGraph = "eq=brightness=0.5,vflip"
+
+// ReadFilterGraphFile reads a filtergraph description from a file. Line breaks are allowed
+// between filters, as in FFmpeg filter scripts.
+func ReadFilterGraphFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading filtergraph file failed: %w", err)
+	}
+	description := strings.TrimSpace(string(data))
+	if description == "" {
+		return "", fmt.Errorf("filtergraph file %s is empty", path)
+	}
+	return description, nil
+}
+
+// validateFilterGraph checks that a description parses into a filtergraph, i.e. that its
+// syntax, filter names and options are valid. Whether the filters accept the frames is only
+// known once the first frame arrives.
+func validateFilterGraph(description string) error {
+	f := newFFmpegFilter(description)
+	defer f.Close()
+	return f.build(astiav.PixelFormatYuv420P, 640, 480, astiav.NewRational(1, 30))
+}
+
+// ffmpegFilter runs frames through an FFmpeg filtergraph
+type ffmpegFilter struct {
+	description string
+	timeBase    astiav.Rational
+
+	filterGraph *astiav.FilterGraph
+	// filterFrames are the frames returned by the previous call
+	filterFrames      []*astiav.Frame
+	buffersinkContext *astiav.BuffersinkFilterContext
+	buffersrcContext  *astiav.BuffersrcFilterContext
+}
+
+func newFFmpegFilter(description string) *ffmpegFilter {
+	return &ffmpegFilter{description: description}
+}
+
+func (f *ffmpegFilter) Init(format astiav.PixelFormat, width, height int, timeBase astiav.Rational) error {
+	if err := f.build(format, width, height, timeBase); err != nil {
+		return err
+	}
+
+	if err := f.filterGraph.Configure(); err != nil {
+		return fmt.Errorf("configuring filtergraph %q failed: %w", f.description, err)
+	}
+	return nil
+}
+
+// build replaces the graph with one parsed from the description, between a buffer source
+// for the given frames and a buffer sink. It still has to be configured.
+func (f *ffmpegFilter) build(format astiav.PixelFormat, width, height int, timeBase astiav.Rational) error {
+	f.Close()
+	f.timeBase = timeBase
+
+	if f.filterGraph = astiav.AllocFilterGraph(); f.filterGraph == nil {
+		return errors.New("filtergraph could not be created")
+	}
+
+	// Alloc outputs
+	outputs := astiav.AllocFilterInOut()
+	if outputs == nil {
+		return errors.New("main: outputs is nil")
+	}
+	defer outputs.Free()
+
+	// Alloc inputs
+	inputs := astiav.AllocFilterInOut()
+	if inputs == nil {
+		return errors.New("main: inputs is nil")
+	}
+	defer inputs.Free()
+
+	// Create source buffer filters
+	buffersrc := astiav.FindFilterByName("buffer")
+	if buffersrc == nil {
+		return errors.New("buffersrc is nil")
+	}
+
+	// Create sink buffer filters
+	buffersink := astiav.FindFilterByName("buffersink")
+	if buffersink == nil {
+		return errors.New("buffersink is nil")
+	}
+
+	// Create filter contexts
+	var err error
+	if f.buffersrcContext, err = f.filterGraph.NewBuffersrcFilterContext(
+		buffersrc,
+		"in",
+		astiav.FilterArgs{
+			"pix_fmt":    strconv.Itoa(int(format)),
+			"video_size": strconv.Itoa(width) + "x" + strconv.Itoa(height),
+			"time_base":  timeBase.String(),
+		}); err != nil {
+		return err
+	}
+
+	if f.buffersinkContext, err = f.filterGraph.NewBuffersinkFilterContext(
+		buffersink,
+		"out",
+		nil); err != nil {
+		return fmt.Errorf("main: creating buffersink context failed: %w", err)
+	}
+
+	// Update outputs
+	outputs.SetName("in")
+	outputs.SetFilterContext(f.buffersrcContext.FilterContext())
+	outputs.SetPadIdx(0)
+	outputs.SetNext(nil)
+
+	// Update inputs
+	inputs.SetName("out")
+	inputs.SetFilterContext(f.buffersinkContext.FilterContext())
+	inputs.SetPadIdx(0)
+	inputs.SetNext(nil)
+
+	// Link buffersrc and buffersink through the filters of the description
+	if err := f.filterGraph.Parse(f.description, inputs, outputs); err != nil {
+		return fmt.Errorf("parsing filtergraph %q failed: %w", f.description, err)
+	}
+	return nil
+}
+
+// Process feeds a frame to the graph and returns the filtered frames it has ready. Graphs
+// may buffer frames, or produce several per input.
+func (f *ffmpegFilter) Process(frame *astiav.Frame) ([]*astiav.Frame, error) {
+	if err := f.buffersrcContext.AddFrame(frame, astiav.NewBuffersrcFlags(astiav.BuffersrcFlagKeepRef)); err != nil {
+		return nil, fmt.Errorf("main: adding frame failed: %w", err)
+	}
+	return f.receiveFrames()
+}
+
+// Flush closes the input of the graph and returns the frames it still buffered
+func (f *ffmpegFilter) Flush() ([]*astiav.Frame, error) {
+	if err := f.buffersrcContext.AddFrame(nil, astiav.NewBuffersrcFlags()); err != nil {
+		return nil, fmt.Errorf("main: closing filtergraph input failed: %w", err)
+	}
+	return f.receiveFrames()
+}
+
+// receiveFrames returns the frames the graph has ready, replacing those of the previous call
+func (f *ffmpegFilter) receiveFrames() ([]*astiav.Frame, error) {
+	f.freeFilterFrames()
+	for {
+		frame := astiav.AllocFrame()
+		if err := f.buffersinkContext.GetFrame(frame, astiav.NewBuffersinkFlags()); err != nil {
+			frame.Free()
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return f.filterFrames, nil
+			}
+			return nil, err
+		}
+
+		// Hand the frame on in the time base it came in with
+		if pts := frame.Pts(); pts != astiav.NoPtsValue {
+			frame.SetPts(astiav.RescaleQ(pts, f.buffersinkContext.TimeBase(), f.timeBase))
+		}
+		f.filterFrames = append(f.filterFrames, frame)
+	}
+}
+
+func (f *ffmpegFilter) freeFilterFrames() {
+	freeFrames(f.filterFrames)
+	f.filterFrames = nil
+}
+
+func (f *ffmpegFilter) Close() error {
+	f.freeFilterFrames()
+	if f.filterGraph == nil {
+		return nil
+	}
+	// The filter contexts are freed along with their graph
+	f.filterGraph.Free()
+	f.filterGraph = nil
+	return nil
+}
+
+// setFilterGraph rebuilds the ffmpeg filters of the chain with a new description. A graph
+// that cannot be configured for the current frames is reported and the previous one kept.
+func (c *filterChain) setFilterGraph(description string) error {
+	for _, stage := range c.stages {
+		f, ok := stage.filter.(*ffmpegFilter)
+		if !ok {
+			continue
+		}
+		previous := f.description
+		f.description = description
+		if !stage.initialized {
+			continue
+		}
+		if err := f.Init(stage.format, stage.width, stage.height, c.timeBase); err != nil {
+			fmt.Println("Keeping the previous filtergraph: ", err)
+			f.description = previous
+			if err := f.Init(stage.format, stage.width, stage.height, c.timeBase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asticode/go-astiav"
+)
+
+// FrameFilter is a processing stage between decoding and encoding
+type FrameFilter interface {
+	// Init prepares the filter for frames of the given pixel format, size and time base.
+	// It is called again whenever these change.
+	Init(format astiav.PixelFormat, width, height int, timeBase astiav.Rational) error
+	// Process returns the processed frames, with their pts in the time base given to Init.
+	// A filter may hold frames back and return them along with later ones, so there can be
+	// none, one or several. The returned frames are owned by the filter and stay valid until
+	// the next call, the frame passed in is not kept beyond the call.
+	Process(frame *astiav.Frame) ([]*astiav.Frame, error)
+	// Flush returns the frames the filter still holds at the end of the input, on the same
+	// terms as Process
+	Flush() ([]*astiav.Frame, error)
+	Close() error
+}
+
+// frameFilterNames lists the filters that can be selected on the command line
+var frameFilterNames = []string{"ar", "ffmpeg", "passthrough"}
+
+// newFrameFilter creates the filter with the given name
+func newFrameFilter(name string, config Config) (FrameFilter, error) {
+	switch name {
+	case "ar":
+		return newARFilter(config.AR)
+	case "ffmpeg":
+		return newFFmpegFilter(config.filterGraph()), nil
+	case "passthrough":
+		return passthroughFilter{}, nil
+	}
+	return nil, fmt.Errorf("unknown filter %q, expected one of %s", name, strings.Join(frameFilterNames, ", "))
+}
+
+// passthroughFilter hands frames on unchanged, for measuring the pipeline without processing
+type passthroughFilter struct{}
+
+func (passthroughFilter) Init(astiav.PixelFormat, int, int, astiav.Rational) error { return nil }
+
+func (passthroughFilter) Process(frame *astiav.Frame) ([]*astiav.Frame, error) {
+	return []*astiav.Frame{frame}, nil
+}
+
+func (passthroughFilter) Flush() ([]*astiav.Frame, error) { return nil, nil }
+
+func (passthroughFilter) Close() error { return nil }
+
+// filterStage is a filter of a chain with the frame properties it was initialized for
+type filterStage struct {
+	name   string
+	filter FrameFilter
+
+	initialized bool
+	format      astiav.PixelFormat
+	width       int
+	height      int
+}
+
+// init initializes the filter for the properties of the frame, unless it already is
+func (s *filterStage) init(frame *astiav.Frame, timeBase astiav.Rational) error {
+	if s.initialized && s.format == frame.PixelFormat() && s.width == frame.Width() && s.height == frame.Height() {
+		return nil
+	}
+	if err := s.filter.Init(frame.PixelFormat(), frame.Width(), frame.Height(), timeBase); err != nil {
+		return fmt.Errorf("initializing %s filter failed: %w", s.name, err)
+	}
+	s.initialized = true
+	s.format, s.width, s.height = frame.PixelFormat(), frame.Width(), frame.Height()
+	return nil
+}
+
+// filterChain runs frames through filters one after the other. Each filter is initialized
+// with the properties of the first frame it receives, and again when they change, so the
+// output of a filter does not need to be known in advance.
+type filterChain struct {
+	timeBase astiav.Rational
+	stages   []*filterStage
+	// output holds the frames returned by the previous call
+	output []*astiav.Frame
+}
+
+func newFilterChain(names []string, config Config, timeBase astiav.Rational) (*filterChain, error) {
+	chain := &filterChain{timeBase: timeBase}
+	for _, name := range names {
+		filter, err := newFrameFilter(strings.TrimSpace(name), config)
+		if err != nil {
+			return nil, err
+		}
+		chain.stages = append(chain.stages, &filterStage{name: strings.TrimSpace(name), filter: filter})
+	}
+	return chain, nil
+}
+
+// Process runs the frame through the chain and returns the frames coming out of it, none
+// when a filter held the frame back. They stay valid until the next call.
+func (c *filterChain) Process(frame *astiav.Frame) ([]*astiav.Frame, error) {
+	return c.run([]*astiav.Frame{frame}, false)
+}
+
+// Flush returns the frames the filters still hold at the end of the input, the frames of
+// each filter going through the filters after it
+func (c *filterChain) Flush() ([]*astiav.Frame, error) {
+	return c.run(nil, true)
+}
+
+// run hands frames through the stages. Filters only keep the frames they return until
+// their next call, so the chain takes references to them between two stages.
+func (c *filterChain) run(frames []*astiav.Frame, flush bool) ([]*astiav.Frame, error) {
+	freeFrames(c.output)
+	c.output = nil
+
+	for i, stage := range c.stages {
+		out, err := c.runStage(stage, frames, flush)
+		if i > 0 {
+			freeFrames(frames)
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = out
+	}
+	if len(c.stages) > 0 {
+		c.output = frames
+	}
+	return frames, nil
+}
+
+// runStage runs frames through a filter, followed by the frames it still holds when
+// flushing, and returns references to the frames coming out
+func (c *filterChain) runStage(stage *filterStage, frames []*astiav.Frame, flush bool) ([]*astiav.Frame, error) {
+	var out []*astiav.Frame
+	collect := func(processed []*astiav.Frame, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s filter failed: %w", stage.name, err)
+		}
+		for _, frame := range processed {
+			out = append(out, frame.Clone())
+		}
+		return nil
+	}
+
+	for _, frame := range frames {
+		if err := stage.init(frame, c.timeBase); err != nil {
+			freeFrames(out)
+			return nil, err
+		}
+		if err := collect(stage.filter.Process(frame)); err != nil {
+			freeFrames(out)
+			return nil, err
+		}
+	}
+	// A filter that never got a frame has nothing to flush
+	if flush && stage.initialized {
+		if err := collect(stage.filter.Flush()); err != nil {
+			freeFrames(out)
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func freeFrames(frames []*astiav.Frame) {
+	for _, frame := range frames {
+		frame.Free()
+	}
+}
+
+// has reports whether the chain contains the filter with the given name
+func (c *filterChain) has(name string) bool {
+	for _, stage := range c.stages {
+		if stage.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *filterChain) Close() error {
+	freeFrames(c.output)
+	c.output = nil
+	for _, stage := range c.stages {
+		if err := stage.filter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
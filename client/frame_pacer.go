@@ -0,0 +1,67 @@
+package client
+
+import (
+	"time"
+
+	"github.com/asticode/go-astiav"
+)
+
+// maxPacingDrift is how far a frame may be off its expected wall clock time before the
+// pacer assumes the timestamps jumped (source restart, wrap around) and re-anchors
+const maxPacingDrift = time.Second
+
+// framePacer releases decoded frames at the rate given by their timestamps, so that files
+// and synthetic sources play in real time at their own frame rate. Live sources already
+// deliver frames in real time and are not held back.
+type framePacer struct {
+	timeBase astiav.Rational
+	// nominal frame duration derived from the source frame rate, used when timestamps are missing
+	nominal time.Duration
+
+	started   bool
+	startTime time.Time
+	startPts  int64
+	lastPts   int64
+}
+
+func newFramePacer(timeBase, frameRate astiav.Rational) *framePacer {
+	nominal := time.Second / 30
+	if frameRate.Num() > 0 && frameRate.Den() > 0 {
+		nominal = time.Duration(float64(time.Second) / frameRate.Float64())
+	}
+	return &framePacer{timeBase: timeBase, nominal: nominal}
+}
+
+// toDuration converts a timestamp difference in the pacer time base to wall clock time
+func (p *framePacer) toDuration(ts int64) time.Duration {
+	return time.Duration(astiav.RescaleQ(ts, p.timeBase, astiav.NewRational(1, int(time.Second))))
+}
+
+// wait blocks until the frame with the given pts is due and returns the frame duration,
+// measured as the distance to the previous frame's timestamp
+func (p *framePacer) wait(pts int64) time.Duration {
+	duration := p.nominal
+	if pts == astiav.NoPtsValue {
+		return duration
+	}
+
+	now := time.Now()
+	if !p.started {
+		p.started, p.startTime, p.startPts, p.lastPts = true, now, pts, pts
+		return duration
+	}
+
+	if delta := p.toDuration(pts - p.lastPts); delta > 0 && delta < maxPacingDrift {
+		duration = delta
+	}
+	p.lastPts = pts
+
+	due := p.startTime.Add(p.toDuration(pts - p.startPts))
+	if wait := due.Sub(now); wait > maxPacingDrift || wait < -maxPacingDrift {
+		// Timestamps jumped or processing fell far behind, restart the clock from this frame
+		p.startTime, p.startPts = now, pts
+	} else if wait > 0 {
+		time.Sleep(wait)
+	}
+	return duration
+}
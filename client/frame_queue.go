@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asticode/go-astiav"
+)
+
+// DropPolicy decides what happens to frames while the filters fall behind the input
+type DropPolicy string
+
+const (
+	// DropOldest discards the oldest waiting frame to make room for a new one
+	DropOldest DropPolicy = "drop_oldest"
+	// DropNewest discards new frames while the queue is full
+	DropNewest DropPolicy = "drop_newest"
+	// Passthrough encodes frames unfiltered while newer ones are waiting
+	Passthrough DropPolicy = "passthrough"
+	// ReuseLast encodes the last filtered frame again while newer ones are waiting
+	ReuseLast DropPolicy = "reuse_last"
+)
+
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch policy := DropPolicy(s); policy {
+	case DropOldest, DropNewest, Passthrough, ReuseLast:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown drop policy %q, expected drop_oldest, drop_newest, passthrough or reuse_last", s)
+}
+
+// queuedFrame is a decoded frame waiting to be filtered and encoded
+type queuedFrame struct {
+	frame         *astiav.Frame
+	frameDuration time.Duration
+	// seq numbers the frames in the order they were read, readAt is when the pacer released
+	// the frame
+	seq    int
+	readAt time.Time
+}
+
+// enqueueFrame hands a decoded frame over to the processing loop. With the drop policies,
+// a full queue loses a frame instead of holding the input back; the other policies wait,
+// as the processing loop catches up by not filtering.
+func (vp *VideoProcessor) enqueueFrame(qf *queuedFrame) {
+	switch vp.dropPolicy {
+	case DropNewest:
+		select {
+		case vp.frameQueue <- qf:
+		default:
+			qf.frame.Free()
+			stats.droppedFrames.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case vp.frameQueue <- qf:
+				return
+			default:
+			}
+			// The processing loop may have taken the oldest frame in the meantime
+			select {
+			case old := <-vp.frameQueue:
+				old.frame.Free()
+				stats.droppedFrames.Add(1)
+			default:
+			}
+		}
+	default:
+		vp.frameQueue <- qf
+	}
+}
+
+// filterFrame runs a dequeued frame through the filters, unless newer frames are waiting
+// and the policy skips the filters to catch up. It returns the frames to encode, none when
+// the filters held the frame back and several when they release frames held before.
+func (vp *VideoProcessor) filterFrame(qf *queuedFrame) ([]*astiav.Frame, error) {
+	frame, err := vp.scaleForProcessing(qf.frame)
+	if err != nil {
+		return nil, err
+	}
+
+	// A frame encoded around the filters while frames are in flight to the AR service would
+	// make their answers stale, so the filters are only skipped when they hold no frames
+	if behind := len(vp.frameQueue) > 0; behind && !vp.filters.arInFlight() {
+		switch {
+		case vp.dropPolicy == Passthrough:
+			stats.bypassedFrames.Add(1)
+			return []*astiav.Frame{frame}, nil
+		case vp.dropPolicy == ReuseLast && vp.lastFiltered != nil:
+			// Shown at the time of the frame it replaces
+			stats.reusedFrames.Add(1)
+			vp.lastFiltered.SetPts(frame.Pts())
+			return []*astiav.Frame{vp.lastFiltered}, nil
+		}
+	}
+
+	// Filters keep the decoder timestamp, so frames stay in the decoder time base
+	frames, err := vp.filters.Process(frame)
+	if err != nil {
+		return nil, err
+	}
+	if vp.dropPolicy == ReuseLast && len(frames) > 0 {
+		if vp.lastFiltered != nil {
+			vp.lastFiltered.Free()
+		}
+		vp.lastFiltered = frames[len(frames)-1].Clone()
+	}
+	return frames, nil
+}
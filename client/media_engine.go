@@ -0,0 +1,144 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// supportedRTCPFeedback lists the RTCP feedback mechanisms that can be advertised
+var supportedRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: webrtc.TypeRTCPFBNACK},
+	{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+	{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+	{Type: webrtc.TypeRTCPFBGoogREMB},
+	{Type: webrtc.TypeRTCPFBTransportCC},
+}
+
+// parseRTCPFeedback parses entries such as "nack", "nack pli" or "ccm fir"
+func parseRTCPFeedback(entries []string) ([]webrtc.RTCPFeedback, error) {
+	feedback := make([]webrtc.RTCPFeedback, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fbType, parameter, _ := strings.Cut(entry, " ")
+		fb := webrtc.RTCPFeedback{Type: fbType, Parameter: strings.TrimSpace(parameter)}
+
+		supported := false
+		for _, s := range supportedRTCPFeedback {
+			supported = supported || s == fb
+		}
+		if !supported {
+			return nil, fmt.Errorf("unsupported RTCP feedback %q", entry)
+		}
+		feedback = append(feedback, fb)
+	}
+	return feedback, nil
+}
+
+// hasRTCPFeedback reports whether the feedback of the given type and parameter, as parsed by
+// parseRTCPFeedback, is advertised. "nack pli" alone does not enable generic NACK.
+func hasRTCPFeedback(feedback []webrtc.RTCPFeedback, fbType, parameter string) bool {
+	for _, fb := range feedback {
+		if fb.Type == fbType && fb.Parameter == parameter {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebRTCAPI builds a WebRTC API whose media engine only offers the given codecs, in
+// that order of preference, with the given RTCP feedback. Interceptors are only set up
+// for the feedback that is advertised, receiver reports are sent at the configured interval.
+// With congestion control the outgoing packets carry transport-wide sequence numbers and the
+// bandwidth estimator is handed over through bandwidthEstimatorChan.
+func newWebRTCAPI(codecs []videoCodec, feedback []webrtc.RTCPFeedback, receiver ReceiverConfig, congestion CongestionConfig) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	for _, codec := range codecs {
+		capability := codec.capability(clientConfig.Encoder)
+		capability.RTCPFeedback = feedback
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: capability,
+			PayloadType:        codec.payloadType,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", codec.name, err)
+		}
+	}
+
+	// Opus for the optional audio track, registered for all clients so viewers can receive it
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: opusCapability,
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register opus: %w", err)
+	}
+
+	// RID header extensions, needed to send and receive simulcast layers
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return nil, err
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+
+	if hasRTCPFeedback(feedback, webrtc.TypeRTCPFBNACK, "") {
+		generator, err := nack.NewGeneratorInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		responder, err := nack.NewResponderInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(responder)
+		interceptorRegistry.Add(generator)
+	}
+
+	// Sender and receiver reports
+	receiverReports, err := report.NewReceiverInterceptor(report.ReceiverInterval(receiver.ReportInterval))
+	if err != nil {
+		return nil, err
+	}
+	senderReports, err := report.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(receiverReports)
+	interceptorRegistry.Add(senderReports)
+
+	if hasRTCPFeedback(feedback, webrtc.TypeRTCPFBTransportCC, "") {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+		generator, err := twcc.NewSenderInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(generator)
+
+		if congestion.Enabled {
+			sequencer, err := twcc.NewHeaderExtensionInterceptor()
+			if err != nil {
+				return nil, err
+			}
+			controller, err := newCongestionController(congestion)
+			if err != nil {
+				return nil, err
+			}
+			interceptorRegistry.Add(sequencer)
+			interceptorRegistry.Add(controller)
+		}
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+	), nil
+}
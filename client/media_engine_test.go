@@ -0,0 +1,84 @@
+package client
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseRTCPFeedback(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []webrtc.RTCPFeedback
+		wantErr bool
+	}{
+		{
+			name:    "defaults",
+			entries: []string{"nack", "nack pli", "ccm fir", "goog-remb", "transport-cc"},
+			want:    supportedRTCPFeedback,
+		},
+		{
+			name:    "spaces and empty entries",
+			entries: []string{" nack  pli ", "", "ccm fir"},
+			want:    []webrtc.RTCPFeedback{{Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}},
+		},
+		{
+			name:    "nothing",
+			entries: nil,
+			want:    []webrtc.RTCPFeedback{},
+		},
+		{
+			name:    "unknown type",
+			entries: []string{"nack", "rrtr"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown parameter",
+			entries: []string{"nack sli"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			feedback, err := parseRTCPFeedback(test.entries)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %v, expected an error", feedback)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(feedback, test.want) {
+				t.Errorf("parsed %v, expected %v", feedback, test.want)
+			}
+		})
+	}
+}
+
+func TestHasRTCPFeedback(t *testing.T) {
+	feedback, err := parseRTCPFeedback([]string{"nack pli", "transport-cc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fbType    string
+		parameter string
+		want      bool
+	}{
+		{webrtc.TypeRTCPFBNACK, "pli", true},
+		{webrtc.TypeRTCPFBTransportCC, "", true},
+		// PLI alone does not enable generic NACK
+		{webrtc.TypeRTCPFBNACK, "", false},
+		{webrtc.TypeRTCPFBCCM, "fir", false},
+	}
+	for _, test := range tests {
+		if got := hasRTCPFeedback(feedback, test.fbType, test.parameter); got != test.want {
+			t.Errorf("hasRTCPFeedback(%q, %q) = %v, expected %v", test.fbType, test.parameter, got, test.want)
+		}
+	}
+}
@@ -20,7 +20,18 @@ var (
 
 func handleOffer(conn *websocket.Conn, msg Message){
     fmt.Println("Received offer")
-    peerConnection, videoTrack, err := createPeerConnection(conn)
+
+    // Answer with the best codec offered by the remote peer
+    var codec videoCodec
+    if clientConfig.Role.publishes() {
+        var err error
+        if codec, err = negotiateVideoCodec(msg.Content, localVideoCodecs); err != nil {
+            log.Fatal("Failed to negotiate video codec: ", err)
+        }
+        fmt.Println("Sending video as", codec.name)
+    }
+
+    peerConnection, videoTracks, audioTrack, err := createPeerConnection(conn, codec)
     if err != nil {
 		log.Fatal("Failed to create peer connection: ", err)
     }
@@ -51,7 +62,9 @@ func handleOffer(conn *websocket.Conn, msg Message){
     conn.WriteJSON(answerMsg)
 
     userPeerConnection = peerConnection
-    userVideoTrack = videoTrack
+    userVideoTracks = videoTracks
+    userAudioTrack = audioTrack
+    userVideoCodec = codec
     connectionEstablishedChan <- true
 }
 
@@ -2,73 +2,105 @@ package client
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/jpeg"
+	"image/png"
 	"net"
-	"os"
 
 	"github.com/asticode/go-astiav"
 )
 
 
-func processImageFrame(conn net.Conn, frame *astiav.Frame) error {
-	// Convert frame to RGBA image
+func processImageFrame(conn net.Conn, frame *astiav.Frame, frameID uint64, timestamp int64, format arFormat, quality int) error {
 	width := frame.Width()
 	height := frame.Height()
-	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
-	frame.Data().ToImage(img)
 
-	// Encode the RGBA image to buffer
-	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, img, nil); err != nil {
-		return err
+	var payload []byte
+	if format.raw() {
+		// The frame is already in the pixel format of the payload, send its planes unpadded
+		var err error
+		if payload, err = frame.Data().Bytes(1); err != nil {
+			return fmt.Errorf("getting frame data failed: %w", err)
+		}
+	} else {
+		// Convert frame to RGBA image
+		img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+		frame.Data().ToImage(img)
+
+		// Encode the RGBA image to buffer
+		var buf bytes.Buffer
+		if format == arFormatPNG {
+			// Favour speed over size, the image is only sent over the AR link
+			encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+			if err := encoder.Encode(&buf, img); err != nil {
+				return err
+			}
+		} else if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return err
+		}
+		payload = buf.Bytes()
 	}
 
-    // Send the size of the frame data
-    frameSize := uint32(buf.Len())
-    if err := binary.Write(conn, binary.BigEndian, frameSize); err != nil {
-        return  fmt.Errorf("failed to send frame size: %w", err)
-    }
-
 	// Send the frame data for processing
-	_, err := conn.Write(buf.Bytes())
-	if err != nil {
-		return fmt.Errorf("failed to send frame data: %w", err)
+	header := arFrameHeader{
+		format:    format,
+		frameID:   frameID,
+		timestamp: timestamp,
+		width:     width,
+		height:    height,
 	}
-	return nil
+	return writeARFrame(conn, header, payload)
 }
 
-func receiveProcessedImageFrame(conn net.Conn) (*image.Image, error) {
-    // Read the size of the processed frame
-    var processedFrameSize uint32
-    if err := binary.Read(conn, binary.BigEndian, &processedFrameSize); err != nil {
-        return nil, fmt.Errorf("failed to read processed frame size: %w", err)
-    }
-
-	// Read the processed frame data
-	processedFrameData := make([]byte, processedFrameSize)
-	_, err := conn.Read(processedFrameData)
+// decodeRawPayload copies a processed frame of a raw format into a copy of the frame sent
+func decodeRawPayload(header arFrameHeader, processedFrameData []byte, frame *astiav.Frame) (*astiav.Frame, error) {
+	if header.width != frame.Width() || header.height != frame.Height() {
+		return nil, fmt.Errorf("processed frame of %dx%d does not match the %dx%d sent", header.width, header.height, frame.Width(), frame.Height())
+	}
+	size, err := frame.ImageBufferSize(1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read processed frame data: %w", err)
+		return nil, err
+	}
+	if len(processedFrameData) != size {
+		return nil, fmt.Errorf("processed frame of %d bytes, expected %d", len(processedFrameData), size)
 	}
 
+	processedFrame := frame.Clone()
+	if err := processedFrame.MakeWritable(); err != nil {
+		processedFrame.Free()
+		return nil, fmt.Errorf("main: making frame writable failed: %w", err)
+	}
+	if err := processedFrame.Data().SetBytes(processedFrameData, 1); err != nil {
+		processedFrame.Free()
+		return nil, fmt.Errorf("copying processed data to frame failed: %w", err)
+	}
+	return processedFrame, nil
+}
+
+func decodeImagePayload(header arFrameHeader, processedFrameData []byte, format arFormat) (*image.Image, error) {
 	// Decode the image buffer to image.Image
 	reader := bytes.NewReader(processedFrameData)
-    processed_img, err := jpeg.Decode(reader)
+	decode := jpeg.Decode
+	if format == arFormatPNG {
+		decode = png.Decode
+	}
+    processed_img, err := decode(reader)
     if err != nil {
         return nil, fmt.Errorf("failed to decode image: %w", err)
     }
+	if size := processed_img.Bounds().Size(); size.X != header.width || size.Y != header.height {
+		return nil, fmt.Errorf("image of %dx%d does not match the announced %dx%d", size.X, size.Y, header.width, header.height)
+	}
 	return &processed_img, nil
 }
 
 func convertImageToFrame(img *image.Image, frame *astiav.Frame) (*astiav.Frame, error) {
 	imgRGBA := image.NewRGBA((*img).Bounds())
 	if imgRGBA == nil {
-		return frame, errors.New("Failed to convert image to RGBA format")
+		return nil, errors.New("Failed to convert image to RGBA format")
 	}
 
 	draw.Draw(imgRGBA, imgRGBA.Bounds(), (*img), (*img).Bounds().Min, draw.Over)
@@ -76,45 +108,34 @@ func convertImageToFrame(img *image.Image, frame *astiav.Frame) (*astiav.Frame,
 	processedFrame := frame.Clone()
 
 	if err := processedFrame.MakeWritable(); err != nil {
-		return frame, fmt.Errorf("main: making frame writable failed: %w", err)
+		processedFrame.Free()
+		return nil, fmt.Errorf("main: making frame writable failed: %w", err)
 	}
 
 	if err := processedFrame.Data().FromImage(imgRGBA);  err != nil {
-		return frame, fmt.Errorf("converting processed image to frame failed: %w", err)
+		processedFrame.Free()
+		return nil, fmt.Errorf("converting processed image to frame failed: %w", err)
 	}
 	return processedFrame, nil
 }
 
-func dumpImageToFile(filename string, img *image.Image) error {
-	file, err := os.Create(filename)
-    if err != nil {
-        return err
-    }
-    defer file.Close()
-
-	err = jpeg.Encode(file, *img, nil)
-    if err != nil {
-        return fmt.Errorf("failed to encode image: %w", err)
-    }
-	return nil
-}
-
-func OverlayARFilter(conn net.Conn, frame *astiav.Frame) (*astiav.Frame, error) {	
-	if err := processImageFrame(conn, frame); err != nil {
-		return frame, err
+// processedFrameFromPayload turns the answer of the AR service to a frame into a new frame
+func processedFrameFromPayload(header arFrameHeader, payload []byte, format arFormat, frame *astiav.Frame) (*astiav.Frame, error) {
+	if format.raw() {
+		return decodeRawPayload(header, payload, frame)
 	}
 
-	processed_image, err := receiveProcessedImageFrame(conn)
+	processed_image, err := decodeImagePayload(header, payload, format)
 	if err != nil {
-		return frame, err
+		return nil, err
+	}
+	if size := (*processed_image).Bounds().Size(); size.X != frame.Width() || size.Y != frame.Height() {
+		return nil, fmt.Errorf("processed frame of %dx%d does not match the %dx%d sent", size.X, size.Y, frame.Width(), frame.Height())
 	}
 
 	processed_frame, err := convertImageToFrame(processed_image, frame)
 	if err != nil {
-		return frame, err
+		return nil, err
 	}
-
-	// dumpImageToFile("processed.jpg", processed_image)
-
 	return processed_frame, nil
 }
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// findSender returns the sender carrying the given track
+func findSender(peerConnection *webrtc.PeerConnection, track webrtc.TrackLocal) *webrtc.RTPSender {
+	for _, sender := range peerConnection.GetSenders() {
+		if sender.Track() == track {
+			return sender
+		}
+	}
+	return nil
+}
+
+// readSenderRTCP reads the RTCP sent back by the receiver of a track, or of the simulcast
+// layer with the given RID, which also lets the interceptors (NACK responder, reports)
+// process it, and asks the video processor for a keyframe whenever the receiver reports
+// a lost picture. vp is nil for the audio track, whose RTCP is only read for the interceptors.
+func readSenderRTCP(sender *webrtc.RTPSender, rid string, vp *VideoProcessor) {
+	read := sender.ReadRTCP
+	if rid != "" {
+		read = func() ([]rtcp.Packet, interceptor.Attributes, error) { return sender.ReadSimulcastRTCP(rid) }
+	}
+	for {
+		packets, _, err := read()
+		if err != nil {
+			fmt.Println("Stopped reading RTCP: ", err)
+			return
+		}
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if vp != nil {
+					vp.RequestKeyframe()
+				}
+			}
+		}
+	}
+}
+
+// receiverFeedback watches the sequence numbers of an incoming track. Small gaps are
+// repaired by the NACK interceptor; when a gap is too large or the stream stalls, the
+// lost packets are unlikely to be retransmitted in time and a keyframe is requested
+// with a PLI instead.
+type receiverFeedback struct {
+	peerConnection *webrtc.PeerConnection
+	ssrc           uint32
+	config         ReceiverConfig
+
+	started      bool
+	lastSequence uint16
+	lastPacket   time.Time
+	lastPLI      time.Time
+	lostPackets  uint64
+}
+
+func newReceiverFeedback(peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote, config ReceiverConfig) *receiverFeedback {
+	return &receiverFeedback{
+		peerConnection: peerConnection,
+		ssrc:           uint32(track.SSRC()),
+		config:         config,
+	}
+}
+
+// supportsPLI reports whether PLI was negotiated for the track
+func supportsPLI(track *webrtc.TrackRemote) bool {
+	for _, fb := range track.Codec().RTCPFeedback {
+		if fb.Type == webrtc.TypeRTCPFBNACK && fb.Parameter == "pli" {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *receiverFeedback) onPacket(sequenceNumber uint16) {
+	now := time.Now()
+	if !f.started {
+		// Ask for a keyframe right away so that decoding can start
+		f.started, f.lastSequence, f.lastPacket = true, sequenceNumber, now
+		f.sendPLI("stream started")
+		return
+	}
+
+	// Sequence numbers wrap around, a difference in the upper half means reordering
+	// or a late retransmission, which does not move the stream forward
+	diff := sequenceNumber - f.lastSequence
+	if diff == 0 || diff >= 0x8000 {
+		return
+	}
+
+	stalled := now.Sub(f.lastPacket)
+	missing := uint64(diff - 1)
+	f.lastSequence, f.lastPacket = sequenceNumber, now
+	f.lostPackets += missing
+
+	switch {
+	case f.config.PLIGapPackets > 0 && missing >= uint64(f.config.PLIGapPackets):
+		f.sendPLI(fmt.Sprintf("gap of %d packets", missing))
+	case f.config.PLIGapTimeout > 0 && stalled >= f.config.PLIGapTimeout:
+		f.sendPLI(fmt.Sprintf("no packets for %v", stalled.Round(time.Millisecond)))
+	}
+}
+
+func (f *receiverFeedback) sendPLI(reason string) {
+	if time.Since(f.lastPLI) < f.config.PLIInterval {
+		return
+	}
+	f.lastPLI = time.Now()
+
+	fmt.Printf("Sending PLI (%s), %d packets lost so far\n", reason, f.lostPackets)
+	if err := f.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: f.ssrc}}); err != nil {
+		fmt.Println("Failed to send PLI: ", err)
+	}
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaWeight is the weight of a new sample in the moving averages
+const ewmaWeight = 0.1
+
+// ewma is an exponentially weighted moving average of durations, safe for concurrent use
+type ewma struct {
+	mu      sync.Mutex
+	value   time.Duration
+	samples uint64
+}
+
+func (e *ewma) add(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.value = d
+	} else {
+		e.value += time.Duration(ewmaWeight * float64(d-e.value))
+	}
+	e.samples++
+}
+
+func (e *ewma) get() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value
+}
+
+// known reports whether a sample was added
+func (e *ewma) known() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.samples > 0
+}
+
+// mediaStats collects the timings of the outgoing media
+type mediaStats struct {
+	// arLatency is the round trip to the AR service
+	arLatency ewma
+	// videoLatency is the time from reading a frame to writing it encoded to the track
+	videoLatency ewma
+	// audioDelay is the time from decoding audio to writing it to the track
+	audioDelay ewma
+
+	videoFrames  atomic.Uint64
+	audioSamples atomic.Uint64
+	// droppedAudioSamples did not fit in the queue of samples waiting for the video delay
+	droppedAudioSamples atomic.Uint64
+
+	// Frames the filters could not keep up with, by drop policy: dropped before filtering,
+	// encoded unfiltered, replaced by the last filtered frame, and frames a filter returned
+	// after a newer frame was encoded
+	droppedFrames  atomic.Uint64
+	bypassedFrames atomic.Uint64
+	reusedFrames   atomic.Uint64
+	staleFrames    atomic.Uint64
+
+	// Connections to the AR service established and lost, and frames it did not process
+	arConnects          atomic.Uint64
+	arDisconnects       atomic.Uint64
+	arUnprocessedFrames atomic.Uint64
+
+	// Where the AR scheduler sent frames, and the frames it passed on unprocessed
+	arLocalFrames   atomic.Uint64
+	arEdgeFrames    atomic.Uint64
+	arSkippedFrames atomic.Uint64
+}
+
+var stats = &mediaStats{}
+
+// avOffset returns how far the video lags behind the audio, negative when audio is late
+func (s *mediaStats) avOffset() time.Duration {
+	return s.videoLatency.get() - s.audioDelay.get()
+}
+
+// reportStats prints the collected timings at every interval
+func reportStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		line := fmt.Sprintf("Stats: %d video frames, AR latency %v, video latency %v, %d dropped, %d unfiltered, %d reused, %d out of order",
+			stats.videoFrames.Load(), stats.arLatency.get().Round(time.Millisecond), stats.videoLatency.get().Round(time.Millisecond),
+			stats.droppedFrames.Load(), stats.bypassedFrames.Load(), stats.reusedFrames.Load(), stats.staleFrames.Load())
+		if stats.arConnects.Load() > 0 || stats.arUnprocessedFrames.Load() > 0 {
+			line += fmt.Sprintf(", AR service up %d times, down %d times, %d frames not processed",
+				stats.arConnects.Load(), stats.arDisconnects.Load(), stats.arUnprocessedFrames.Load())
+			line += fmt.Sprintf(", AR frames %d local, %d edge, %d skipped",
+				stats.arLocalFrames.Load(), stats.arEdgeFrames.Load(), stats.arSkippedFrames.Load())
+		}
+		if stats.audioSamples.Load() > 0 {
+			line += fmt.Sprintf(", %d audio samples (%d dropped), audio delay %v, A/V offset %v",
+				stats.audioSamples.Load(), stats.droppedAudioSamples.Load(), stats.audioDelay.get().Round(time.Millisecond), stats.avOffset().Round(time.Millisecond))
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// simulcastLayers are the RIDs and scales of the simulcast encodings, from full to
+// quarter resolution. The first SimulcastLayers entries are published.
+var simulcastLayers = []struct {
+	rid   string
+	scale float64
+}{
+	{"f", 1},
+	{"h", 0.5},
+	{"q", 0.25},
+}
+
+// videoLayer is one encoding of the outgoing video, written to its own track. Without
+// simulcast there is a single layer at the output resolution.
+type videoLayer struct {
+	rid   string
+	scale float64
+	// share is the part of the total bitrate spent on the layer, proportional to its area
+	share float64
+	track *webrtc.TrackLocalStaticSample
+
+	codecContext *astiav.CodecContext
+	packet       *astiav.Packet
+
+	// Converts processed frames to the layer pixel format and resolution
+	scaleContext *astiav.SoftwareScaleContext
+	frame        *astiav.Frame
+
+	// Last decoding timestamp received from the encoder, in encoder time base
+	lastEncodedDts  int64
+	encoderDtsKnown bool
+}
+
+// newVideoLayers returns a layer for each track, with the simulcast scale matching its RID
+func newVideoLayers(tracks []*webrtc.TrackLocalStaticSample) []*videoLayer {
+	layers := make([]*videoLayer, 0, len(tracks))
+	totalArea := 0.0
+	for i, track := range tracks {
+		scale := simulcastLayers[i].scale
+		layers = append(layers, &videoLayer{
+			rid:    track.RID(),
+			scale:  scale,
+			track:  track,
+			packet: astiav.AllocPacket(),
+			frame:  astiav.AllocFrame(),
+		})
+		totalArea += scale * scale
+	}
+	for _, layer := range layers {
+		layer.share = layer.scale * layer.scale / totalArea
+	}
+	return layers
+}
+
+func (l *videoLayer) name() string {
+	if l.rid == "" {
+		return "video"
+	}
+	return "layer " + l.rid
+}
+
+// open allocates and opens the encoder of the layer for the negotiated codec at the given size
+func (l *videoLayer) open(vp *VideoProcessor, width, height int) error {
+	// Find an encoder for the negotiated codec
+	encoder, encoderDefaults := vp.codec.findEncoder()
+	if encoder == nil {
+		return fmt.Errorf("no %s encoder found", vp.codec.name)
+	}
+
+	// Allocate encoding codec context
+	if l.codecContext = astiav.AllocCodecContext(encoder); l.codecContext == nil {
+		return errors.New("Failed to AllocCodecContext Decoder")
+	}
+
+	// Update encoding codec context
+	l.codecContext.SetPixelFormat(astiav.PixelFormatYuv420P)
+	l.codecContext.SetSampleAspectRatio(vp.source.sampleAspectRatio)
+	l.codecContext.SetTimeBase(vp.encoderTimeBase)
+	l.codecContext.SetFramerate(vp.sourceFrameRate())
+	l.codecContext.SetWidth(width)
+	l.codecContext.SetHeight(height)
+
+	if profile, ok, err := vp.encoder.profile(); err != nil {
+		return err
+	} else if ok && vp.codec.name == "h264" {
+		l.codecContext.SetProfile(profile)
+	}
+	// The level advertised in SDP, checked against the output by checkLevel
+	if vp.codec.name == "h264" {
+		level, err := vp.encoder.level()
+		if err != nil {
+			return err
+		}
+		l.codecContext.SetLevel(astiav.Level(level.idc))
+	}
+
+	// Apply rate control, GOP, preset and any extra encoder options, with the layer's share of the bitrate
+	options, err := vp.encoder.forShare(l.share).codecOptions(vp.codec, encoderDefaults)
+	if err != nil {
+		return err
+	}
+	encoderOptions, err := options.dictionary()
+	if err != nil {
+		return err
+	}
+	if encoderOptions != nil {
+		defer encoderOptions.Free()
+	}
+
+	// Open encoding codec context
+	if err = l.codecContext.Open(encoder, encoderOptions); err != nil {
+		return err
+	}
+	l.encoderDtsKnown = false
+	fmt.Printf("Opened %s encoder %s for %s at %dx%d with options: %s\n", vp.codec.name, encoder.Name(), l.name(), width, height, options)
+	return nil
+}
+
+// convert returns the frame in the layer pixel format and resolution. The scale context
+// is recreated whenever the frame or the encoder size changes.
+func (l *videoLayer) convert(frame *astiav.Frame) (*astiav.Frame, error) {
+	width, height, format := l.codecContext.Width(), l.codecContext.Height(), l.codecContext.PixelFormat()
+	if frame.Width() == width && frame.Height() == height && frame.PixelFormat() == format {
+		return frame, nil
+	}
+
+	if c := l.scaleContext; c == nil ||
+		c.SourceWidth() != frame.Width() || c.SourceHeight() != frame.Height() || c.SourcePixelFormat() != frame.PixelFormat() ||
+		c.DestinationWidth() != width || c.DestinationHeight() != height {
+		if c != nil {
+			c.Free()
+		}
+
+		var err error
+		if l.scaleContext, err = astiav.CreateSoftwareScaleContext(
+			frame.Width(),
+			frame.Height(),
+			frame.PixelFormat(),
+			width,
+			height,
+			format,
+			astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	// A new buffer for every frame, the encoder may still hold a reference to the previous one
+	l.frame.Unref()
+	if err := l.scaleContext.ScaleFrame(frame, l.frame); err != nil {
+		return nil, err
+	}
+	return l.frame, nil
+}
+
+// encode sends the frame to the layer encoder with the given pts, forcing a keyframe if
+// asked to, and writes the packets that are ready to the track
+func (l *videoLayer) encode(frame *astiav.Frame, pts int64, keyframe bool, frameDuration time.Duration) error {
+	layerFrame, err := l.convert(frame)
+	if err != nil {
+		return err
+	}
+	layerFrame.SetPts(pts)
+
+	layerFrame.SetPictureType(astiav.PictureTypeNone)
+	if keyframe {
+		layerFrame.SetPictureType(astiav.PictureTypeI)
+	}
+	if err = l.codecContext.SendFrame(layerFrame); err != nil {
+		return err
+	}
+	return l.writePackets(frameDuration)
+}
+
+// flush drains the encoder before it is replaced
+func (l *videoLayer) flush(frameDuration time.Duration) error {
+	if err := l.codecContext.SendFrame(nil); err != nil {
+		return err
+	}
+	return l.writePackets(frameDuration)
+}
+
+// writePackets writes the packets the encoder has ready to the track
+func (l *videoLayer) writePackets(frameDuration time.Duration) error {
+	for {
+		// Read encoded packets
+		l.packet.Unref()
+		if err := l.codecContext.ReceivePacket(l.packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return err
+		}
+
+		// Write the encoded frame to the track
+		if err := l.track.WriteSample(media.Sample{Data: l.packet.Data(), Duration: l.sampleDuration(l.packet, frameDuration)}); err != nil {
+			return err
+		}
+	}
+}
+
+// sampleDuration returns the duration of an encoded packet as the distance between its
+// decoding timestamp and the previous packet's, or fallback when that is not known
+func (l *videoLayer) sampleDuration(packet *astiav.Packet, fallback time.Duration) time.Duration {
+	dts := packet.Dts()
+	if dts == astiav.NoPtsValue {
+		return fallback
+	}
+
+	duration := fallback
+	if l.encoderDtsKnown && dts > l.lastEncodedDts {
+		timeBase := l.codecContext.TimeBase()
+		duration = time.Duration(astiav.RescaleQ(dts-l.lastEncodedDts, timeBase, astiav.NewRational(1, int(time.Second))))
+	}
+	l.lastEncodedDts = dts
+	l.encoderDtsKnown = true
+	return duration
+}
+
+func (l *videoLayer) free() {
+	l.codecContext.Free()
+	l.packet.Free()
+	if l.scaleContext != nil {
+		l.scaleContext.Free()
+	}
+	l.frame.Free()
+}
@@ -4,43 +4,116 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/asticode/go-astiav"
+	"github.com/pion/webrtc/v3"
 )
 
 type VideoProcessor struct {
+	input       InputConfig
+	audioConfig AudioConfig
+	encoder    EncoderConfig
+	codec      videoCodec
+	congestion CongestionConfig
+
 	inputFormatContext *astiav.FormatContext
 
 	videoStream *astiav.Stream
+	// audioStream is the audio of the input, when the audio track is taken from it
+	audioStream *astiav.Stream
+	audio       *AudioProcessor
 
 	decodeCodecContext *astiav.CodecContext
 	decodePacket       *astiav.Packet
 	decodeFrame        *astiav.Frame
-
-	encodeCodecContext *astiav.CodecContext
-	encodePacket *astiav.Packet
-
-	convertToRGBAContext *astiav.SoftwareScaleContext
-	convertToYUV420PContext *astiav.SoftwareScaleContext
-	rgbaFrame *astiav.Frame
-	yuv420PFrame *astiav.Frame
-
-	filterGraph *astiav.FilterGraph
-	filterFrame *astiav.Frame
-	buffersinkContext *astiav.BuffersinkFilterContext
-	buffersrcContext  *astiav.BuffersrcFilterContext
-
-	arFilterFrame *astiav.Frame
-
-	pts int64
+	// source holds the properties of the decoded video. The decoder belongs to readFrames
+	// once run has started, so the processing loop and the controls only read these.
+	source videoSource
+
+	// One encoder per published layer, all in encoderTimeBase
+	layers          []*videoLayer
+	encoderTimeBase astiav.Rational
+
+	// Scales decoded frames to the processing resolution, nil when it is the source resolution
+	processingScaleContext *astiav.SoftwareScaleContext
+	processingFrame        *astiav.Frame
+
+	// Resolutions of the AR stage and of the encoded video, 0 follows the previous stage,
+	// and the cap on the encoded frame rate, 0 for the source rate
+	processingWidth  int
+	processingHeight int
+	outputWidth      int
+	outputHeight     int
+	outputFrameRate  int
+
+	// Settings changed at runtime, applied between two frames
+	controls chan func() error
+
+	// Processing stage between decoding and encoding
+	filters *filterChain
+
+	// Decoded frames waiting for the filters, and what happens when they fall behind
+	frameQueue   chan *queuedFrame
+	dropPolicy   DropPolicy
+	lastFiltered *astiav.Frame
+	// lastSourcePts is the decoder pts of the last frame encoded
+	lastSourcePts int64
+
+	// Last timestamp handed to the encoders, in encoder time base
+	lastEncoderPts int64
+	encoderStarted bool
+
+	// Looping playback state, in video stream time base
+	loopPtsOffset int64
+	loopEndPts    int64
+	loopCount     int
+
+	frameCount int
+	// frameReads holds when the frames not encoded yet were released by the pacer, in the
+	// order they were read. Filters may hold frames back, so they are only removed once a
+	// frame is encoded.
+	frameReads []frameRead
+
+	pacer *framePacer
+
+	// Keyframes requested by the receiver through PLI/FIR
+	keyframeRequested  atomic.Bool
+	lastForcedKeyframe time.Time
+
+	// Bandwidth adaptation, targetBitrate is the latest estimate in bit/s, 0 when unknown
+	targetBitrate  atomic.Int64
+	appliedBitrate int64
+	tier           DowngradeTier
+	// nextFrameAt is when the next frame may be encoded under the frame rate cap
+	nextFrameAt time.Duration
 }
 
-const h264FrameDuration = time.Millisecond * 20
+// videoSource describes the decoded video
+type videoSource struct {
+	width             int
+	height            int
+	pixelFormat       astiav.PixelFormat
+	timeBase          astiav.Rational
+	frameRate         astiav.Rational
+	sampleAspectRatio astiav.Rational
+}
 
-func NewVideoProcessor() *VideoProcessor {
-	vp := &VideoProcessor{}
+// NewVideoProcessor opens the input and an encoder for each track, the tracks being the
+// simulcast layers from full to lowest resolution
+func NewVideoProcessor(config Config, codec videoCodec, tracks []*webrtc.TrackLocalStaticSample) *VideoProcessor {
+	vp := &VideoProcessor{input: config.Input, audioConfig: config.Audio, encoder: config.Encoder, codec: codec, congestion: config.Congestion}
+	vp.layers = newVideoLayers(tracks)
+	vp.controls = make(chan func() error, 16)
+	vp.frameQueue = make(chan *queuedFrame, config.Pipeline.QueueSize)
+	vp.dropPolicy = config.Pipeline.DropPolicy
+	vp.lastSourcePts = astiav.NoPtsValue
+
+	// The sizes were checked by Config.Validate
+	vp.processingWidth, vp.processingHeight, _ = parseSize(config.Output.ProcessingSize)
+	vp.outputWidth, vp.outputHeight, _ = parseSize(config.Output.Size)
+	vp.outputFrameRate = config.Output.FrameRate
 
 	astiav.RegisterAllDevices()
 
@@ -51,6 +124,12 @@ func NewVideoProcessor() *VideoProcessor {
 		log.Fatal("Failed to initialize video encoding: ", err)
 	}
 
+	filters, err := newFilterChain(config.Filters, config, vp.source.timeBase)
+	if err != nil {
+		log.Fatal("Failed to set up filters: ", err)
+	}
+	vp.filters = filters
+
 	return vp
 }
 
@@ -59,18 +138,67 @@ func (vp *VideoProcessor) initTestSrc() error {
 		return errors.New("Failed to AllocCodecContext")
 	}
 
-	// Open input
-	if err := vp.inputFormatContext.OpenInput("udp://224.0.0.251:5353", nil, nil); err != nil {
+	url, inputFormatName := vp.input.URL, vp.input.Format
+	if vp.input.TestPattern.Enabled {
+		url, inputFormatName = vp.input.TestPattern.graph(true), "lavfi"
+	}
+
+	// Find the forced input format, if any
+	var inputFormat *astiav.InputFormat
+	if inputFormatName != "" {
+		if inputFormat = astiav.FindInputFormat(inputFormatName); inputFormat == nil {
+			return fmt.Errorf("unknown input format %q", inputFormatName)
+		}
+	}
+
+	// Build demuxer options
+	inputOptions, err := vp.input.Options.dictionary()
+	if err != nil {
 		return err
 	}
+	if inputOptions != nil {
+		defer inputOptions.Free()
+	}
+
+	// Open input
+	if err := vp.inputFormatContext.OpenInput(url, inputFormat, inputOptions); err != nil {
+		if !vp.input.TestPattern.Enabled {
+			return fmt.Errorf("opening input %s failed: %w", url, err)
+		}
+
+		// drawtext is missing from FFmpeg builds without libfreetype, fall back to the bare pattern
+		fmt.Println("Failed to open test pattern with text overlay, retrying without it: ", err)
+		url = vp.input.TestPattern.graph(false)
+		if err := vp.inputFormatContext.OpenInput(url, inputFormat, inputOptions); err != nil {
+			return fmt.Errorf("opening test pattern %s failed: %w", url, err)
+		}
+	}
 
 	// Find stream info
 	if err := vp.inputFormatContext.FindStreamInfo(nil); err != nil {
 		return err
 	}
 
-	// Set stream
-	vp.videoStream = vp.inputFormatContext.Streams()[0]
+	// Set stream to the first video stream of the input
+	for _, stream := range vp.inputFormatContext.Streams() {
+		if stream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+			vp.videoStream = stream
+			break
+		}
+	}
+	if vp.videoStream == nil {
+		return fmt.Errorf("no video stream found in %s", url)
+	}
+
+	// Audio is taken from the same input unless it has its own
+	if vp.audioConfig.Enabled && vp.audioConfig.URL == "" {
+		for _, stream := range vp.inputFormatContext.Streams() {
+			if stream.CodecParameters().MediaType() == astiav.MediaTypeAudio {
+				vp.audioStream = stream
+				break
+			}
+		}
+	}
 
 	// Find decoder
 	decoder := astiav.FindDecoder(vp.videoStream.CodecParameters().CodecID())
@@ -88,13 +216,23 @@ func (vp *VideoProcessor) initTestSrc() error {
 		return err
 	}
 
-	// Set framerate
+	// Set framerate and decode in the stream time base so frame timestamps can drive pacing
 	vp.decodeCodecContext.SetFramerate(vp.inputFormatContext.GuessFrameRate(vp.videoStream, nil))
+	vp.decodeCodecContext.SetTimeBase(vp.videoStream.TimeBase())
+	vp.pacer = newFramePacer(vp.decodeCodecContext.TimeBase(), vp.decodeCodecContext.Framerate())
 
 	// Open decoding codec context
 	if err := vp.decodeCodecContext.Open(decoder, nil); err != nil {
 		panic(err)
 	}
+	vp.source = videoSource{
+		width:             vp.decodeCodecContext.Width(),
+		height:            vp.decodeCodecContext.Height(),
+		pixelFormat:       vp.decodeCodecContext.PixelFormat(),
+		timeBase:          vp.decodeCodecContext.TimeBase(),
+		frameRate:         vp.decodeCodecContext.Framerate(),
+		sampleAspectRatio: vp.decodeCodecContext.SampleAspectRatio(),
+	}
 
 	vp.decodePacket = astiav.AllocPacket()
 	vp.decodeFrame = astiav.AllocFrame()
@@ -102,144 +240,360 @@ func (vp *VideoProcessor) initTestSrc() error {
 	return nil
 }
 
-func (vp *VideoProcessor) initVideoEncoding() error {
-	if vp.encodeCodecContext != nil {
-		return nil
+// readVideoPacket reads the next packet of the selected video stream into decodePacket.
+// Audio packets are handed to the audio processor on the way, other streams are skipped.
+func (vp *VideoProcessor) readVideoPacket() error {
+	for {
+		vp.decodePacket.Unref()
+		if err := vp.inputFormatContext.ReadFrame(vp.decodePacket); err != nil {
+			if errors.Is(err, astiav.ErrEof) && vp.input.Loop {
+				if err = vp.rewindInput(); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+		if vp.decodePacket.StreamIndex() == vp.videoStream.Index() {
+			vp.shiftLoopTimestamps()
+			return nil
+		}
+		if vp.audio != nil && vp.decodePacket.StreamIndex() == vp.audioStream.Index() {
+			vp.audio.queuePacket(vp.decodePacket)
+		}
 	}
+}
 
-	// Find H264 encoder
-	h264Encoder := astiav.FindEncoder(astiav.CodecIDH264)
-	if h264Encoder == nil {
-		return errors.New("No H264 Encoder Found")
+// rewindInput seeks back to the start of the input so that playback loops.
+// Timestamps of the next pass are shifted to continue after the last packet read.
+func (vp *VideoProcessor) rewindInput() error {
+	startTime := vp.videoStream.StartTime()
+	if startTime == astiav.NoPtsValue {
+		startTime = 0
 	}
 
-	// Allocate encoding codec context
-	if vp.encodeCodecContext = astiav.AllocCodecContext(h264Encoder); vp.encodeCodecContext == nil {
-		return errors.New("Failed to AllocCodecContext Decoder")
+	if err := vp.inputFormatContext.SeekFrame(vp.videoStream.Index(), startTime, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+		return fmt.Errorf("seeking back to the start of the input failed: %w", err)
 	}
 
-	// Update encoding codec context
-	vp.encodeCodecContext.SetPixelFormat(astiav.PixelFormatYuv420P)
-	vp.encodeCodecContext.SetSampleAspectRatio(vp.decodeCodecContext.SampleAspectRatio())
-	vp.encodeCodecContext.SetTimeBase(astiav.NewRational(1, 30))
-	vp.encodeCodecContext.SetWidth(vp.decodeCodecContext.Width())
-	vp.encodeCodecContext.SetHeight(vp.decodeCodecContext.Height())
+	vp.loopPtsOffset = vp.loopEndPts - startTime
+	vp.loopCount++
+	fmt.Printf("Looping input, pass %d\n", vp.loopCount+1)
+	return nil
+}
 
-	// Open encoding codec context
-	err := vp.encodeCodecContext.Open(h264Encoder, nil); 
-	if err != nil {
-		return err
+func (vp *VideoProcessor) shiftLoopTimestamps() {
+	// Default to one frame when the demuxer does not report packet durations
+	duration := vp.decodePacket.Duration()
+	if duration <= 0 {
+		duration = astiav.RescaleQ(1, vp.inputFormatContext.GuessFrameRate(vp.videoStream, nil).Invert(), vp.videoStream.TimeBase())
 	}
-	
-	// create a scale context to convert frames to RGBA format
-	vp.convertToRGBAContext, err = astiav.CreateSoftwareScaleContext(
-		vp.decodeCodecContext.Width(),
-		vp.decodeCodecContext.Height(),
-		vp.decodeCodecContext.PixelFormat(),
-		vp.decodeCodecContext.Width(),
-		vp.decodeCodecContext.Height(),
-		astiav.PixelFormatRgba,
-		astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear),
-	)
 
-	if err != nil {
-		return err
+	if pts := vp.decodePacket.Pts(); pts != astiav.NoPtsValue {
+		vp.decodePacket.SetPts(pts + vp.loopPtsOffset)
+		if end := vp.decodePacket.Pts() + duration; end > vp.loopEndPts {
+			vp.loopEndPts = end
+		}
+	}
+	if dts := vp.decodePacket.Dts(); dts != astiav.NoPtsValue {
+		vp.decodePacket.SetDts(dts + vp.loopPtsOffset)
 	}
+}
 
-	// create a scale context to convert frames to YUV420P format
-	vp.convertToYUV420PContext, err = astiav.CreateSoftwareScaleContext(
-		vp.convertToRGBAContext.DestinationWidth(),
-		vp.convertToRGBAContext.DestinationHeight(),
-		vp.convertToRGBAContext.DestinationPixelFormat(),
-		vp.convertToRGBAContext.SourceWidth(),
-		vp.convertToRGBAContext.SourceHeight(),
-		astiav.PixelFormatYuv420P,
-		vp.convertToRGBAContext.Flags(),
-	)
+// sourceFrameRate returns the frame rate of the video stream, falling back to 30 fps
+// when the input does not tell
+func (vp *VideoProcessor) sourceFrameRate() astiav.Rational {
+	if frameRate := vp.source.frameRate; frameRate.Num() > 0 && frameRate.Den() > 0 {
+		return frameRate
+	}
+	return astiav.NewRational(30, 1)
+}
+
+// encodedFrameRate returns the frame rate of the encoded video, the source rate capped by
+// the output frame rate
+func (vp *VideoProcessor) encodedFrameRate() float64 {
+	frameRate := vp.sourceFrameRate().Float64()
+	if vp.outputFrameRate > 0 {
+		frameRate = min(frameRate, float64(vp.outputFrameRate))
+	}
+	return frameRate
+}
 
+// checkLevel returns an error when the output size and frame rate exceed the H.264 level
+// negotiated in SDP. The lower layers and downgrade tiers only ever encode less.
+func (vp *VideoProcessor) checkLevel() error {
+	if vp.codec.name != "h264" {
+		return nil
+	}
+	level, err := vp.encoder.level()
 	if err != nil {
 		return err
 	}
+	width, height := vp.outputSize()
+	if !level.fits(width, height, vp.encodedFrameRate()) {
+		return fmt.Errorf("%dx%d at %.0f fps exceeds H.264 level %s, lower the output size or frame rate or raise --h264_level",
+			width, height, vp.encodedFrameRate(), vp.encoder.Level)
+	}
+	return nil
+}
+
+// encoderPts rescales a source timestamp into the encoder time base. The result is kept
+// strictly increasing since encoders reject repeated timestamps, and frames without a
+// timestamp are placed right after the previous one.
+func (vp *VideoProcessor) encoderPts(pts int64, timeBase astiav.Rational) int64 {
+	encoderPts := vp.lastEncoderPts + 1
+	if pts != astiav.NoPtsValue {
+		encoderPts = astiav.RescaleQ(pts, timeBase, vp.encoderTimeBase)
+		if vp.encoderStarted && encoderPts <= vp.lastEncoderPts {
+			encoderPts = vp.lastEncoderPts + 1
+		}
+	}
+	vp.lastEncoderPts = encoderPts
+	vp.encoderStarted = true
+	return encoderPts
+}
 
-	vp.rgbaFrame = astiav.AllocFrame()
-	vp.yuv420PFrame = astiav.AllocFrame()
+// RequestKeyframe makes the encoder produce a keyframe as soon as the rate limit allows.
+// Requests arriving in the meantime are merged into one.
+func (vp *VideoProcessor) RequestKeyframe() {
+	if !vp.keyframeRequested.Swap(true) {
+		fmt.Println("Keyframe requested by receiver")
+	}
+}
 
+// keyframeDue reports whether the frame about to be encoded has to be a keyframe because
+// one was requested; otherwise the encoders decide
+func (vp *VideoProcessor) keyframeDue() bool {
+	if !vp.keyframeRequested.Load() || time.Since(vp.lastForcedKeyframe) < vp.encoder.KeyframeRequestInterval {
+		return false
+	}
+
+	vp.keyframeRequested.Store(false)
+	vp.lastForcedKeyframe = time.Now()
+	return true
+}
+
+// frameLimitReached reports whether the configured number of frames has been processed
+func (vp *VideoProcessor) frameLimitReached() bool {
+	return vp.input.FrameCount > 0 && vp.frameCount >= vp.input.FrameCount
+}
+
+// AttachAudio encodes the audio of the input to the track. Without a separate audio input,
+// the test pattern gets a test tone and other inputs must have an audio stream.
+func (vp *VideoProcessor) AttachAudio(track *webrtc.TrackLocalStaticSample) error {
+	config := vp.audioConfig
+	if config.URL == "" && vp.input.TestPattern.Enabled {
+		config.URL, config.Format = "sine=frequency=440:sample_rate=48000", "lavfi"
+	}
+	if config.URL != "" {
+		audio, err := NewAudioProcessor(config, track, nil)
+		if err != nil {
+			return err
+		}
+		go audio.run()
+		return nil
+	}
+
+	if vp.audioStream == nil {
+		return errors.New("the input has no audio stream")
+	}
+	audio, err := NewAudioProcessor(config, track, vp.audioStream)
+	if err != nil {
+		return err
+	}
+	vp.audio = audio
+	go audio.decodePackets()
 	return nil
 }
 
-func (vp *VideoProcessor) initFilters() error {
-	if vp.filterGraph = astiav.AllocFilterGraph(); vp.filterGraph == nil {
-		return errors.New("filtergraph could not be created")
+func (vp *VideoProcessor) initVideoEncoding() error {
+	if err := vp.checkLevel(); err != nil {
+		return err
+	}
+	vp.encoderTimeBase = vp.sourceFrameRate().Invert()
+	for _, layer := range vp.layers {
+		width, height := vp.encoderSize(layer.scale)
+		if err := layer.open(vp, width, height); err != nil {
+			return err
+		}
 	}
 
-	// Alloc outputs
-	outputs := astiav.AllocFilterInOut()
-	if outputs == nil {
-		return errors.New("main: outputs is nil")
+	vp.processingFrame = astiav.AllocFrame()
+	return vp.initProcessingScale()
+}
+
+// processingSize returns the resolution of the frames handed to the filters
+func (vp *VideoProcessor) processingSize() (int, int) {
+	if vp.processingWidth > 0 {
+		return vp.processingWidth, vp.processingHeight
 	}
+	return vp.source.width, vp.source.height
+}
 
-	// Alloc inputs
-	inputs := astiav.AllocFilterInOut()
-	if inputs == nil {
-		return errors.New("main: inputs is nil")
+// outputSize returns the resolution of the full encoded layer, before downgrade tiers
+func (vp *VideoProcessor) outputSize() (int, int) {
+	if vp.outputWidth > 0 {
+		return vp.outputWidth, vp.outputHeight
 	}
+	return vp.processingSize()
+}
 
-	// Create source buffer filters
-	buffersrc := astiav.FindFilterByName("buffer")
-	if buffersrc == nil {
-		return errors.New("buffersrc is nil")
+// initProcessingScale creates the scale context converting decoded frames to the processing
+// resolution, replacing any previous one. None is needed at the source resolution.
+func (vp *VideoProcessor) initProcessingScale() error {
+	if vp.processingScaleContext != nil {
+		vp.processingScaleContext.Free()
+		vp.processingScaleContext = nil
 	}
+	// The destination buffers are allocated again at the new size
+	vp.processingFrame.Unref()
 
-	// Create sink buffer filters
-	buffersink := astiav.FindFilterByName("buffersink")
-	if buffersink == nil {
-		return errors.New("buffersink is nil")
+	width, height := vp.processingSize()
+	if width == vp.source.width && height == vp.source.height {
+		return nil
 	}
 
-	// Create filter contexts 
 	var err error
-	if vp.buffersrcContext, err = vp.filterGraph.NewBuffersrcFilterContext(
-		buffersrc, 
-		"in", 
-		astiav.FilterArgs{
-			"pix_fmt":      strconv.Itoa(int(vp.decodeCodecContext.PixelFormat())),
-			"video_size":   strconv.Itoa(vp.decodeCodecContext.Width()) + "x" + strconv.Itoa(vp.decodeCodecContext.Height()),
-			"time_base":    vp.videoStream.TimeBase().String(),
-		}); err != nil {
+	vp.processingScaleContext, err = astiav.CreateSoftwareScaleContext(
+		vp.source.width,
+		vp.source.height,
+		vp.source.pixelFormat,
+		width,
+		height,
+		vp.source.pixelFormat,
+		astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear),
+	)
+	return err
+}
+
+// scaleForProcessing returns a decoded frame at the processing resolution
+func (vp *VideoProcessor) scaleForProcessing(frame *astiav.Frame) (*astiav.Frame, error) {
+	if vp.processingScaleContext == nil {
+		return frame, nil
+	}
+	// A new buffer for every frame, filters and the drop policy keep references to the
+	// previous ones
+	vp.processingFrame.Unref()
+	if err := vp.processingScaleContext.ScaleFrame(frame, vp.processingFrame); err != nil {
+		return nil, err
+	}
+	vp.processingFrame.SetPts(frame.Pts())
+	return vp.processingFrame, nil
+}
+
+// SetProcessingSize changes the resolution of the filters from the next frame on, 0x0
+// going back to the source resolution. The encoders follow unless an output size is set.
+func (vp *VideoProcessor) SetProcessingSize(width, height int) {
+	vp.controls <- func() error {
+		previousWidth, previousHeight := vp.processingWidth, vp.processingHeight
+		vp.processingWidth, vp.processingHeight = width, height
+		if err := vp.checkLevel(); err != nil {
+			vp.processingWidth, vp.processingHeight = previousWidth, previousHeight
+			fmt.Println("Keeping the processing size: ", err)
+			return nil
+		}
+		fmt.Printf("Processing at %dx%d\n", width, height)
+		if err := vp.initProcessingScale(); err != nil {
 			return err
 		}
-
-	if vp.buffersinkContext, err = vp.filterGraph.NewBuffersinkFilterContext(
-		buffersink, 
-		"in", 
-		nil); err != nil {
-		return fmt.Errorf("main: creating buffersink context failed: %w", err)
+		if vp.outputWidth > 0 {
+			return nil
+		}
+		return vp.reopenEncoders(vp.pacer.nominal)
 	}
+}
 
-	// Update outputs
-	outputs.SetName("in")
-	outputs.SetFilterContext(vp.buffersrcContext.FilterContext())
-	outputs.SetPadIdx(0)
-	outputs.SetNext(nil)
+// SetOutputSize changes the encoded resolution from the next frame on, reopening the
+// encoders. 0x0 goes back to the processing resolution.
+func (vp *VideoProcessor) SetOutputSize(width, height int) {
+	vp.controls <- func() error {
+		previousWidth, previousHeight := vp.outputWidth, vp.outputHeight
+		vp.outputWidth, vp.outputHeight = width, height
+		if err := vp.checkLevel(); err != nil {
+			vp.outputWidth, vp.outputHeight = previousWidth, previousHeight
+			fmt.Println("Keeping the output size: ", err)
+			return nil
+		}
+		fmt.Printf("Encoding at %dx%d\n", width, height)
+		return vp.reopenEncoders(vp.pacer.nominal)
+	}
+}
 
-	// Update inputs
-	inputs.SetName("out")
-	inputs.SetFilterContext(vp.buffersinkContext.FilterContext())
-	inputs.SetPadIdx(0)
-	inputs.SetNext(nil)
+// SetOutputFrameRate caps the encoded frame rate from the next frame on, 0 for the source rate
+func (vp *VideoProcessor) SetOutputFrameRate(frameRate int) {
+	vp.controls <- func() error {
+		previousFrameRate := vp.outputFrameRate
+		vp.outputFrameRate = frameRate
+		if err := vp.checkLevel(); err != nil {
+			vp.outputFrameRate = previousFrameRate
+			fmt.Println("Keeping the output frame rate: ", err)
+			return nil
+		}
+		vp.nextFrameAt = 0
+		fmt.Printf("Encoding at up to %d fps\n", frameRate)
+		return nil
+	}
+}
 
-	// Link buffersrc and buffersink through the eq filter for brightness, vertically flip the image frame
-	if err := vp.filterGraph.Parse("eq=brightness=0.5,vflip", inputs, outputs); err != nil {
+// SetFilterGraph replaces the graph of the ffmpeg filters from the next frame on. The
+// description is checked here, a graph that does not fit the frames keeps the previous one.
+func (vp *VideoProcessor) SetFilterGraph(description string) error {
+	if !vp.filters.has("ffmpeg") {
+		return errors.New("no ffmpeg filter in the filter chain")
+	}
+	if err := validateFilterGraph(description); err != nil {
 		return err
 	}
+	vp.controls <- func() error {
+		fmt.Printf("Filtering with %q\n", description)
+		return vp.filters.setFilterGraph(description)
+	}
+	return nil
+}
+
+// applyControls applies the settings changed since the previous frame
+func (vp *VideoProcessor) applyControls() error {
+	for {
+		select {
+		case control := <-vp.controls:
+			if err := control(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
 
-	if err := vp.filterGraph.Configure(); err != nil {
-		return fmt.Errorf("main: configuring filter failed: %w", err)
+// encoderSize returns the resolution of a layer with the given scale, the output resolution
+// scaled by the active downgrade tier and the layer, rounded down to even dimensions for YUV420P
+func (vp *VideoProcessor) encoderSize(layerScale float64) (int, int) {
+	width, height := vp.outputSize()
+	scale := layerScale
+	if vp.tier.Scale > 0 && vp.tier.Scale < 1 {
+		scale *= vp.tier.Scale
 	}
+	if scale < 1 {
+		width, height = int(float64(width)*scale), int(float64(height)*scale)
+	}
+	return max(width&^1, 2), max(height&^1, 2)
+}
 
-	// Allocate frame to store the filtered contents
-	vp.filterFrame = astiav.AllocFrame()
+// reopenEncoders replaces the encoders with new ones at the current encoder sizes, after
+// draining them. The new encoders start with a keyframe, so receivers pick up the
+// resolution change.
+func (vp *VideoProcessor) reopenEncoders(frameDuration time.Duration) error {
+	for _, layer := range vp.layers {
+		if err := layer.flush(frameDuration); err != nil {
+			return err
+		}
+		layer.codecContext.Free()
 
+		width, height := vp.encoderSize(layer.scale)
+		if err := layer.open(vp, width, height); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -251,16 +605,22 @@ func (vp *VideoProcessor) freeVideoCoding() {
 	vp.decodePacket.Free()
 	vp.decodeFrame.Free()
 
-	vp.encodeCodecContext.Free()
-	vp.encodePacket.Free()
+	for _, layer := range vp.layers {
+		layer.free()
+	}
+	if vp.audio != nil {
+		vp.audio.stop()
+	}
 
-	vp.convertToRGBAContext.Free()
-	vp.convertToYUV420PContext.Free()
-	vp.rgbaFrame.Free()
-	vp.yuv420PFrame.Free()
+	if vp.processingScaleContext != nil {
+		vp.processingScaleContext.Free()
+	}
+	vp.processingFrame.Free()
 
-	vp.buffersrcContext.FilterContext().Free()
-	vp.buffersinkContext.FilterContext().Free()
-	vp.filterFrame.Free()
-	vp.filterGraph.Free()
+	if vp.lastFiltered != nil {
+		vp.lastFiltered.Free()
+	}
+	if err := vp.filters.Close(); err != nil {
+		fmt.Println("Failed to close filters: ", err)
+	}
 }
\ No newline at end of file
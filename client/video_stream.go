@@ -5,13 +5,13 @@ import (
 	"fmt"
 	"image/color"
 	"log"
-	"net"
+	"os"
 	"os/exec"
+	"slices"
 	"time"
 
 	"github.com/asticode/go-astiav"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
@@ -22,39 +22,94 @@ var (
 )
 
 
-func openCameraFeed(peerConnection *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticSample, generate_stats bool) error {
+func openCameraFeed(peerConnection *webrtc.PeerConnection, videoTracks []*webrtc.TrackLocalStaticSample, audioTrack *webrtc.TrackLocalStaticSample, generate_stats bool) error {
+    if clientConfig.Role.views() {
+        receiveRemoteTracks(peerConnection)
+    }
+
+    // Viewers have no camera, so neither the input nor the AR service is opened
+    if !clientConfig.Role.publishes() {
+        fmt.Println("Running as viewer, not opening the camera feed")
+        return nil
+    }
+
+    fmt.Println("Writing to tracks")
+    vp := NewVideoProcessor(clientConfig, userVideoCodec, videoTracks)
+    if audioTrack != nil {
+        if err := vp.AttachAudio(audioTrack); err != nil {
+            fmt.Println("Not sending audio: ", err)
+        }
+    }
+	if(generate_stats){
+		go generate_plots()
+		go reportStats(time.Second)
+	}
+    // Answer PLI/FIR from the receiver with a keyframe, on any of the simulcast layers
+    if sender := findSender(peerConnection, videoTracks[0]); sender != nil {
+        for _, track := range videoTracks {
+            go readSenderRTCP(sender, track.RID(), vp)
+        }
+    }
+    // Audio NACKs and receiver reports only reach the interceptors when its RTCP is read
+    if audioTrack != nil {
+        if sender := findSender(peerConnection, audioTrack); sender != nil {
+            go readSenderRTCP(sender, "", nil)
+        }
+    }
+    if clientConfig.Congestion.Enabled {
+        followBandwidthEstimate(vp)
+    }
+
+    // Resolution and frame rate can be changed at runtime from stdin
+    go readControlCommands(os.Stdin, vp)
+
+    go vp.run()
+    return nil
+}
+
+func receiveRemoteTracks(peerConnection *webrtc.PeerConnection) {
     // Handle incoming tracks
     peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
         fmt.Println("Track received:", track.Kind())
         fmt.Println("Track Codec:", track.Codec())
         fmt.Println("Track Codec MimeType:", track.Codec().MimeType)
+        if track.RID() != "" {
+            fmt.Println("Track simulcast layer:", track.RID())
+        }
+        var feedback *receiverFeedback
+        if supportsPLI(track) {
+            feedback = newReceiverFeedback(peerConnection, track, clientConfig.Receiver)
+        }
         go func() {
             for {
-                // Read frames from the track
-                _, _, err := track.ReadRTP()
+                // Read frames from the track, NACKs are generated by the interceptors
+                packet, _, err := track.ReadRTP()
                 if err != nil {
                     log.Println("Error reading RTP:", err)
                     return
                 }
+                if feedback != nil {
+                    feedback.onPacket(packet.SequenceNumber)
+                }
 
                 // Handle the frames as needed and render into a video element
                 // fmt.Println(packet)
             }
         }()
     })
-
-    fmt.Println("Writing to tracks")
-    vp := NewVideoProcessor()
-	if(generate_stats){
-		go generate_plots()
-	}
-    go vp.writeH264ToTrackAR(videoTrack)
-	// go vp.writeH264ToTrackFFmpegFilters(videoTrack)
-    return nil
 }
 
-func establishSSHTunnel() (*exec.Cmd, error) {
-	cmd := exec.Command("ssh", "-L", "5005:127.0.0.1:5005", "-J", "fastvideo", "-i", "~/.ssh/picluster", "epl@10.100.1.165")
+// establishSSHTunnel forwards a local port to the destination over SSH, through the jump
+// host and with the identity file when they are given
+func establishSSHTunnel(forward, destination, jump, identity string) (*exec.Cmd, error) {
+	args := []string{"-N", "-L", forward}
+	if jump != "" {
+		args = append(args, "-J", jump)
+	}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	cmd := exec.Command("ssh", append(args, destination)...)
 	err := cmd.Start()
 	if err != nil {
 		return nil, fmt.Errorf("failed to start SSH tunnel: %w", err)
@@ -65,8 +120,11 @@ func establishSSHTunnel() (*exec.Cmd, error) {
 }
 
 func closeSSHTunnel(cmd *exec.Cmd) error {
+	// The tunnel runs until it is stopped, so ssh exiting on the signal is expected
+	cmd.Process.Kill()
 	err := cmd.Wait()
-	if err != nil {
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
 		return fmt.Errorf("error waiting for SSH tunnel process: %w", err)
 	}
 	return nil
@@ -125,97 +183,81 @@ func generate_plots() {
 }
 
 
-func (vp *VideoProcessor) writeH264ToTrackAR(track *webrtc.TrackLocalStaticSample) {
+// run reads, decodes and paces the input in the background, and hands every frame through
+// the filter chain to the encoders, until the input or the frame limit is reached. Frames
+// the filters cannot keep up with are dropped according to the drop policy.
+func (vp *VideoProcessor) run() {
 	defer vp.freeVideoCoding()
 
-    conn, err := net.Dial("tcp", "127.0.0.1:5005")
-    if err != nil {
-        panic(err)
-    }
-    defer conn.Close()
+	go vp.readFrames()
+
+	var err error
 
-    ticker := time.NewTicker(h264FrameDuration)
-	for ; true; <-ticker.C {
+	for qf := range vp.frameQueue {
 		startTime := time.Now()
-		
-		if err = vp.inputFormatContext.ReadFrame(vp.decodePacket); err != nil {
-			if errors.Is(err, astiav.ErrEof) {
-				break
-			}
+
+		// Apply settings changed at runtime before processing the frame
+		if err = vp.applyControls(); err != nil {
 			panic(err)
 		}
-		vp.decodePacket.RescaleTs(vp.videoStream.TimeBase(), vp.decodeCodecContext.TimeBase())
+		vp.frameReads = append(vp.frameReads, frameRead{seq: qf.seq, pts: qf.frame.Pts(), readAt: qf.readAt})
 
-		if err = vp.decodeCodecContext.SendPacket(vp.decodePacket); err != nil {
+		frames, err := vp.filterFrame(qf)
+		if err != nil {
 			panic(err)
 		}
-	
-		for {
-			if err = vp.decodeCodecContext.ReceiveFrame(vp.decodeFrame); err != nil {
-				if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
-					// fmt.Println("Error while receiving decoded framed: ", err)
-					break
-				}
-				panic(err)
-			}
-
-			if err = vp.convertToRGBAContext.ScaleFrame(vp.decodeFrame, vp.rgbaFrame); err != nil {
+		for _, frame := range frames {
+			if err = vp.encodeFrame(frame, vp.source.timeBase, qf.frameDuration); err != nil {
 				panic(err)
 			}
+		}
+		qf.frame.Free()
 
-			vp.pts++
-			vp.rgbaFrame.SetPts(vp.pts)
-
-			startTime2 := time.Now()
-            vp.arFilterFrame, err = OverlayARFilter(conn, vp.rgbaFrame)
-			if err != nil {
-				fmt.Println("Failed to add AR filter to frame: ", err)
-			}
-			_ = time.Since(startTime2)
-			// timeChan <- float64(elapsedTime2.Milliseconds())
-
-			if err = vp.convertToYUV420PContext.ScaleFrame(vp.arFilterFrame, vp.yuv420PFrame); err != nil {
-				panic(err)
-			}
+		elapsedTime := time.Since(startTime)
+		// Only collected with --generate_stats, never hold the pipeline for the plot
+		select {
+		case timeChan <- float64(elapsedTime.Milliseconds()):
+		default:
+		}
+	}
 
-			vp.pts++
-			vp.yuv420PFrame.SetPts(vp.pts)
-			
-			if err = vp.encodeCodecContext.SendFrame(vp.yuv420PFrame); err != nil {
-				panic(err)
-			}
+	if err = vp.flush(); err != nil {
+		panic(err)
+	}
 
-			for {
-				// Read encoded packets
-				vp.encodePacket = astiav.AllocPacket()
-				if err = vp.encodeCodecContext.ReceivePacket(vp.encodePacket); err != nil {
-					if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
-						break
-					}
-					panic(err)
-				}
+	fmt.Printf("Dropped %d frames, passed %d unfiltered, reused %d, discarded %d out of order\n",
+		stats.droppedFrames.Load(), stats.bypassedFrames.Load(), stats.reusedFrames.Load(), stats.staleFrames.Load())
+}
 
-				// Write H264 to track
-				if err = track.WriteSample(media.Sample{Data: vp.encodePacket.Data(), Duration: h264FrameDuration}); err != nil {
-					panic(err)
-				}
-			}
+// flush encodes the frames the filters still hold at the end of the input, such as those
+// in flight to the AR service, then drains the encoders, so that every frame read is sent
+func (vp *VideoProcessor) flush() error {
+	frames, err := vp.filters.Flush()
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := vp.encodeFrame(frame, vp.source.timeBase, vp.pacer.nominal); err != nil {
+			return err
+		}
+	}
+	for _, layer := range vp.layers {
+		if err := layer.flush(vp.pacer.nominal); err != nil {
+			return fmt.Errorf("flushing %s failed: %w", layer.name(), err)
 		}
-		elapsedTime := time.Since(startTime)
-		timeChan <- float64(elapsedTime.Milliseconds())
 	}
+	return nil
 }
 
-func (vp *VideoProcessor) writeH264ToTrackFFmpegFilters(track *webrtc.TrackLocalStaticSample) {
-	defer vp.freeVideoCoding()
-	vp.initFilters()
+// readFrames reads, decodes and paces the input, queueing the decoded frames for run. The
+// queue is closed at the end of the input or when the frame limit is reached.
+func (vp *VideoProcessor) readFrames() {
+	defer close(vp.frameQueue)
 
 	var err error
 
-    ticker := time.NewTicker(h264FrameDuration)
-	for ; true; <-ticker.C {
-		startTime := time.Now()
-		if err = vp.inputFormatContext.ReadFrame(vp.decodePacket); err != nil {
+	for {
+		if err = vp.readVideoPacket(); err != nil {
 			if errors.Is(err, astiav.ErrEof) {
 				break
 			}
@@ -235,49 +277,78 @@ func (vp *VideoProcessor) writeH264ToTrackFFmpegFilters(track *webrtc.TrackLocal
 				}
 				panic(err)
 			}
-			
-			// startTime2 := time.Now()
-			if err = vp.buffersrcContext.AddFrame(vp.decodeFrame, astiav.NewBuffersrcFlags(astiav.BuffersrcFlagKeepRef)); err != nil {
-				err = fmt.Errorf("main: adding frame failed: %w", err)
+
+			if vp.frameLimitReached() {
+				fmt.Printf("Processed %d frames, stopping\n", vp.frameCount)
 				return
 			}
+			vp.frameCount++
 
-			for{
-				vp.filterFrame.Unref()
-				if err = vp.buffersinkContext.GetFrame(vp.filterFrame, astiav.NewBuffersinkFlags()); err != nil {
-					if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
-						break
-					}
-					panic(err)
-				}
-	
-				vp.pts++
-				vp.filterFrame.SetPts(vp.pts)
+			// Hold the frame until it is due according to its timestamp
+			frameDuration := vp.pacer.wait(vp.decodeFrame.Pts())
 
-				if err = vp.encodeCodecContext.SendFrame(vp.filterFrame); err != nil {
-					panic(err)
-				}
+			// The decoder reuses its frame, the queue keeps a reference of its own
+			vp.enqueueFrame(&queuedFrame{frame: vp.decodeFrame.Clone(), frameDuration: frameDuration, seq: vp.frameCount, readAt: time.Now()})
+		}
+	}
+}
 
-				for {
-					// Read encoded packets
-					vp.encodePacket = astiav.AllocPacket()
-					if err = vp.encodeCodecContext.ReceivePacket(vp.encodePacket); err != nil {
-						if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
-							break
-						}
-						panic(err)
-					}
-	
-					// Write H264 to track
-					if err = track.WriteSample(media.Sample{Data: vp.encodePacket.Data(), Duration: h264FrameDuration}); err != nil {
-						panic(err)
-					}
-				}
-			}
-			// elapsedTime2 := time.Since(startTime2)
-			// timeChan <- float64(elapsedTime2.Milliseconds())
+// encodeFrame encodes a processed frame, whose pts is in timeBase, on every layer and writes
+// the resulting samples to the layer tracks. The bitrate follows the bandwidth estimate, and
+// frames are dropped while a downgrade tier caps the frame rate.
+func (vp *VideoProcessor) encodeFrame(frame *astiav.Frame, timeBase astiav.Rational, frameDuration time.Duration) error {
+	readAt, ok := vp.takeFrameRead(frame.Pts())
+	if frame.Pts() != astiav.NoPtsValue {
+		// A filter held this frame back while a newer one was encoded without it
+		if vp.lastSourcePts != astiav.NoPtsValue && frame.Pts() < vp.lastSourcePts {
+			stats.staleFrames.Add(1)
+			return nil
 		}
-		elapsedTime := time.Since(startTime)
-		timeChan <- float64(elapsedTime.Milliseconds())
+		vp.lastSourcePts = frame.Pts()
+	}
+	if err := vp.adaptToBandwidth(frameDuration); err != nil {
+		return err
+	}
+	if vp.skipForFrameRate(frame.Pts(), timeBase) {
+		return nil
+	}
+
+	pts := vp.encoderPts(frame.Pts(), timeBase)
+	keyframe := vp.keyframeDue()
+	for _, layer := range vp.layers {
+		if err := layer.encode(frame, pts, keyframe, frameDuration); err != nil {
+			return fmt.Errorf("encoding %s failed: %w", layer.name(), err)
+		}
+	}
+
+	// The audio is delayed by this latency to stay in sync
+	if ok {
+		stats.videoLatency.add(time.Since(readAt))
+	}
+	stats.videoFrames.Add(1)
+	return nil
+}
+
+// frameRead records when a frame was released by the pacer
+type frameRead struct {
+	seq    int
+	pts    int64
+	readAt time.Time
+}
+
+// takeFrameRead returns when the frame with the given pts was read, forgetting it along
+// with the frames read before it, which were dropped on the way if they are still there.
+// Filters keep the pts but not the frame, and keep frames in order, so a frame is matched
+// to the oldest read with its pts, and a frame without pts to the oldest read.
+func (vp *VideoProcessor) takeFrameRead(pts int64) (time.Time, bool) {
+	i := 0
+	if pts != astiav.NoPtsValue {
+		i = slices.IndexFunc(vp.frameReads, func(read frameRead) bool { return read.pts == pts })
+	}
+	if i < 0 || i >= len(vp.frameReads) {
+		return time.Time{}, false
 	}
+	read := vp.frameReads[i]
+	vp.frameReads = slices.DeleteFunc(vp.frameReads, func(r frameRead) bool { return r.seq <= read.seq })
+	return read.readAt, true
 }
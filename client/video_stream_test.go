@@ -0,0 +1,50 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astiav"
+)
+
+func TestTakeFrameRead(t *testing.T) {
+	start := time.Now()
+	readAt := func(seq int) time.Time { return start.Add(time.Duration(seq) * time.Millisecond) }
+
+	tests := []struct {
+		name string
+		// pts of the frames read, numbered in order
+		read []int64
+		// pts of the frame encoded
+		pts      int64
+		wantSeq  int
+		wantOk   bool
+		wantLeft int
+	}{
+		{name: "first frame", read: []int64{0, 1, 2}, pts: 0, wantSeq: 0, wantOk: true, wantLeft: 2},
+		{name: "frames before were dropped", read: []int64{0, 1, 2}, pts: 1, wantSeq: 1, wantOk: true, wantLeft: 1},
+		{name: "repeated pts takes the oldest", read: []int64{5, 6, 5, 6}, pts: 6, wantSeq: 1, wantOk: true, wantLeft: 2},
+		{name: "no pts takes the oldest", read: []int64{astiav.NoPtsValue, astiav.NoPtsValue}, pts: astiav.NoPtsValue, wantSeq: 0, wantOk: true, wantLeft: 1},
+		{name: "unknown pts", read: []int64{0, 1}, pts: 7, wantLeft: 2},
+		{name: "nothing read", pts: astiav.NoPtsValue},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vp := &VideoProcessor{}
+			for seq, pts := range test.read {
+				vp.frameReads = append(vp.frameReads, frameRead{seq: seq, pts: pts, readAt: readAt(seq)})
+			}
+
+			got, ok := vp.takeFrameRead(test.pts)
+			if ok != test.wantOk {
+				t.Fatalf("found %v, expected %v", ok, test.wantOk)
+			}
+			if ok && !got.Equal(readAt(test.wantSeq)) {
+				t.Errorf("got the read of frame %v, expected frame %d", got.Sub(start), test.wantSeq)
+			}
+			if len(vp.frameReads) != test.wantLeft {
+				t.Errorf("%d reads left, expected %d", len(vp.frameReads), test.wantLeft)
+			}
+		})
+	}
+}
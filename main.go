@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 	"websocket_tests/client"
 	server "websocket_tests/signalling_server"
 )
@@ -12,6 +15,71 @@ func main(){
     clientFlag := flag.Bool("client", false, "Run as client")
     serverFlag := flag.Bool("server", false, "Run as server")
 	generateStatsFlag := flag.Bool("generate_stats", false, "Generate statistics for client")
+	roleFlag := flag.String("role", "both", "Client role: publisher, viewer or both")
+	inputFlag := flag.String("input", "udp://224.0.0.251:5353", "Video input URL, file or device")
+	inputFormatFlag := flag.String("input_format", "", "Input format, e.g. v4l2, lavfi or mpegts (probed when empty)")
+	inputOptions := client.Options{}
+	flag.Var(inputOptions, "input_option", "Demuxer option as key=value, may be repeated")
+	loopFlag := flag.Bool("loop", false, "Loop the input when it reaches the end")
+	frameCountFlag := flag.Int("frame_count", 0, "Stop after this many frames (0 for no limit)")
+	testPatternFlag := flag.Bool("test_pattern", false, "Use the built-in test pattern instead of --input")
+	testPatternSizeFlag := flag.String("test_pattern_size", "640x480", "Resolution of the test pattern")
+	testPatternRateFlag := flag.Int("test_pattern_rate", 30, "Frame rate of the test pattern")
+	audioFlag := flag.Bool("audio", false, "Send an Opus audio track along with the video")
+	audioInputFlag := flag.String("audio_input", "", "Separate audio input URL, file or device (audio of --input when empty)")
+	audioInputFormatFlag := flag.String("audio_input_format", "", "Audio input format, e.g. alsa, pulse or lavfi (probed when empty)")
+	audioInputOptions := client.Options{}
+	flag.Var(audioInputOptions, "audio_input_option", "Audio demuxer option as key=value, may be repeated")
+	audioBitrateFlag := flag.Int("audio_bitrate", 64, "Opus bitrate in kbit/s")
+	audioDelayFlag := flag.Duration("audio_delay", 0, "Hold audio back by this fixed amount")
+	lipSyncFlag := flag.Bool("lip_sync", true, "Also delay audio by the measured video processing latency")
+	filtersFlag := flag.String("filters", "ar", "Comma separated processing stages applied in order: ar, ffmpeg, passthrough")
+	filterGraphFlag := flag.String("filter_graph", "", "FFmpeg filtergraph run by the ffmpeg filter (eq=brightness=0.5,vflip when empty)")
+	filterGraphFileFlag := flag.String("filter_graph_file", "", "File holding the FFmpeg filtergraph, instead of --filter_graph")
+	arAddressFlag := flag.String("ar_address", "127.0.0.1:5005", "Comma separated addresses of the AR service instances used by the ar filter")
+	arBalancerFlag := flag.String("ar_balancer", "round_robin", "How frames are spread over the AR service instances: round_robin or least_latency")
+	arFormatFlag := flag.String("ar_format", "jpeg", "Payload format of frames sent to the AR service: rgba, bgr, yuv420p, png or jpeg")
+	arJPEGQualityFlag := flag.Int("ar_jpeg_quality", 75, "JPEG quality (1-100) of frames sent to the AR service with --ar_format=jpeg")
+	arInFlightFlag := flag.Int("ar_in_flight", 1, "Frames sent to the AR service ahead of its answers")
+	arTimeoutFlag := flag.Duration("ar_timeout", time.Second, "Time the AR service has to answer a frame before it is considered down")
+	arEdgeAddressFlag := flag.String("ar_edge_address", "", "Comma separated addresses of the AR service instances on edge nodes")
+	arEdgeSSHTunnelFlag := flag.String("ar_edge_ssh_tunnel", "", "Open an SSH tunnel to the edge node with this -L forward, e.g. 5006:127.0.0.1:5005")
+	arEdgeSSHFlag := flag.String("ar_edge_ssh", "", "Destination of the SSH tunnel to the edge node as user@host")
+	arEdgeSSHJumpFlag := flag.String("ar_edge_ssh_jump", "", "Jump host the SSH tunnel to the edge node goes through")
+	arEdgeSSHIdentityFlag := flag.String("ar_edge_ssh_identity", "", "Private key file of the SSH tunnel to the edge node")
+	arPolicyFlag := flag.String("ar_policy", "pool", "Where frames are processed: pool, local_first, edge_first or fastest")
+	arLatencyBudgetFlag := flag.Duration("ar_latency_budget", 150*time.Millisecond, "Round trip an AR frame may take before the scheduler moves or skips it")
+	arDecisionLogFlag := flag.String("ar_decision_log", "", "CSV file the AR scheduling decisions are written to")
+	queueSizeFlag := flag.Int("queue_size", 1, "Decoded frames that can wait for the filters")
+	dropPolicyFlag := flag.String("drop_policy", "drop_oldest", "What to do while the filters fall behind: drop_oldest, drop_newest, passthrough or reuse_last")
+	arSizeFlag := flag.String("ar_size", "", "Resolution of the AR stage as WIDTHxHEIGHT (source resolution when empty)")
+	outputSizeFlag := flag.String("output_size", "", "Encoded resolution as WIDTHxHEIGHT (AR stage resolution when empty)")
+	outputFrameRateFlag := flag.Int("output_frame_rate", 0, "Maximum encoded frame rate (0 for the source rate)")
+	bitrateFlag := flag.Int("bitrate", 0, "Target encoder bitrate in kbit/s (0 for the encoder default)")
+	maxBitrateFlag := flag.Int("max_bitrate", 0, "Maximum encoder bitrate in kbit/s (0 for no cap)")
+	rateControlFlag := flag.String("rate_control", "", "Rate control mode: cbr, vbr or crf")
+	crfFlag := flag.Int("crf", 23, "Constant rate factor used with --rate_control=crf")
+	keyintFlag := flag.Int("keyint", 0, "Keyframe interval in frames (0 for the encoder default)")
+	bframesFlag := flag.Int("bframes", 0, "Number of B-frames (-1 for the encoder default)")
+	profileFlag := flag.String("profile", "constrained_baseline", "H264 profile: baseline, constrained_baseline, main or high")
+	levelFlag := flag.String("h264_level", "3.1", "H264 level advertised and encoded, e.g. 3.1 for up to 1280x720 at 30 fps or 4.2 for 1920x1080 at 60 fps")
+	presetFlag := flag.String("preset", "", "H264 encoder preset, e.g. ultrafast or veryfast")
+	tuneFlag := flag.String("tune", "zerolatency", "H264 encoder tune, e.g. zerolatency")
+	codecFlag := flag.String("codec", "h264", "Comma separated video codecs in order of preference: h264, vp8, vp9, av1")
+	receiverReportIntervalFlag := flag.Duration("receiver_report_interval", time.Second, "Interval between RTCP receiver reports")
+	pliGapPacketsFlag := flag.Int("pli_gap_packets", 30, "Send a PLI when this many packets are missing at once (0 to disable)")
+	pliGapTimeoutFlag := flag.Duration("pli_gap_timeout", time.Second, "Send a PLI when no packet arrived for this long (0 to disable)")
+	pliIntervalFlag := flag.Duration("pli_interval", time.Second, "Minimum time between two PLIs")
+	rtcpFeedbackFlag := flag.String("rtcp_feedback", "nack,nack pli,ccm fir,goog-remb,transport-cc", "Comma separated RTCP feedback advertised for video")
+	keyframeIntervalFlag := flag.Duration("keyframe_request_interval", 500*time.Millisecond, "Minimum time between keyframes forced by PLI/FIR")
+	congestionControlFlag := flag.Bool("congestion_control", false, "Adapt the encoder bitrate to the bandwidth estimate (needs transport-cc feedback)")
+	ccInitialBitrateFlag := flag.Int("cc_initial_bitrate", 1000, "Initial bandwidth estimate in kbit/s")
+	ccMinBitrateFlag := flag.Int("cc_min_bitrate", 100, "Minimum bandwidth estimate in kbit/s")
+	ccMaxBitrateFlag := flag.Int("cc_max_bitrate", 5000, "Maximum bandwidth estimate in kbit/s")
+	downgradeTiersFlag := flag.String("downgrade_tiers", "", "Comma separated kbps:scale:fps tiers applied below a bandwidth estimate, e.g. 800:0.75:0,400:0.5:15")
+	simulcastLayersFlag := flag.Int("simulcast_layers", 1, "Number of simulcast layers to publish: 1 (off), 2 (full, half) or 3 (full, half, quarter)")
+	encoderOptions := client.Options{}
+	flag.Var(encoderOptions, "encoder_option", "Encoder option as key=value, may be repeated")
 
     // Parse the command-line flags
     flag.Parse()
@@ -19,7 +87,111 @@ func main(){
 	if *serverFlag {
 		server.Run()
 	} else if *clientFlag {
-		client.Run(*generateStatsFlag)
+		role, err := client.ParseRole(*roleFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		downgradeTiers, err := client.ParseDowngradeTiers(*downgradeTiersFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dropPolicy, err := client.ParseDropPolicy(*dropPolicyFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filterGraph := *filterGraphFlag
+		if *filterGraphFileFlag != "" {
+			if filterGraph != "" {
+				log.Fatal("--filter_graph and --filter_graph_file are mutually exclusive")
+			}
+			if filterGraph, err = client.ReadFilterGraphFile(*filterGraphFileFlag); err != nil {
+				log.Fatal(err)
+			}
+		}
+		client.Run(client.Config{
+			Role:          role,
+			GenerateStats: *generateStatsFlag,
+			Input: client.InputConfig{
+				URL:        *inputFlag,
+				Format:     *inputFormatFlag,
+				Options:    inputOptions,
+				Loop:       *loopFlag,
+				FrameCount: *frameCountFlag,
+				TestPattern: client.TestPatternConfig{
+					Enabled:   *testPatternFlag,
+					Size:      *testPatternSizeFlag,
+					FrameRate: *testPatternRateFlag,
+				},
+			},
+			Audio: client.AudioConfig{
+				Enabled: *audioFlag,
+				URL:     *audioInputFlag,
+				Format:  *audioInputFormatFlag,
+				Options: audioInputOptions,
+				Bitrate: *audioBitrateFlag,
+				Delay:   *audioDelayFlag,
+				LipSync: *lipSyncFlag,
+			},
+			Filters:     strings.Split(*filtersFlag, ","),
+			FilterGraph: filterGraph,
+			AR: client.ARConfig{
+				Addresses:   strings.Split(*arAddressFlag, ","),
+				Balancer:    *arBalancerFlag,
+				Format:      *arFormatFlag,
+				JPEGQuality: *arJPEGQualityFlag,
+				MaxInFlight: *arInFlightFlag,
+				Timeout:     *arTimeoutFlag,
+
+				EdgeAddresses:   strings.Split(*arEdgeAddressFlag, ","),
+				EdgeSSHTunnel:   *arEdgeSSHTunnelFlag,
+				EdgeSSH:         *arEdgeSSHFlag,
+				EdgeSSHJump:     *arEdgeSSHJumpFlag,
+				EdgeSSHIdentity: *arEdgeSSHIdentityFlag,
+				Policy:          *arPolicyFlag,
+				LatencyBudget:   *arLatencyBudgetFlag,
+				DecisionLog:     *arDecisionLogFlag,
+			},
+			Pipeline: client.PipelineConfig{
+				QueueSize:  *queueSizeFlag,
+				DropPolicy: dropPolicy,
+			},
+			Output: client.OutputConfig{
+				ProcessingSize: *arSizeFlag,
+				Size:           *outputSizeFlag,
+				FrameRate:      *outputFrameRateFlag,
+			},
+			Encoder: client.EncoderConfig{
+				Bitrate:          *bitrateFlag,
+				MaxBitrate:       *maxBitrateFlag,
+				RateControl:      *rateControlFlag,
+				CRF:              *crfFlag,
+				KeyframeInterval: *keyintFlag,
+				BFrames:          *bframesFlag,
+				Profile:          *profileFlag,
+				Level:            *levelFlag,
+				Preset:           *presetFlag,
+				Tune:             *tuneFlag,
+				Options:          encoderOptions,
+
+				KeyframeRequestInterval: *keyframeIntervalFlag,
+			},
+			Codecs:       strings.Split(*codecFlag, ","),
+			RTCPFeedback: strings.Split(*rtcpFeedbackFlag, ","),
+			Receiver: client.ReceiverConfig{
+				ReportInterval: *receiverReportIntervalFlag,
+				PLIGapPackets:  *pliGapPacketsFlag,
+				PLIGapTimeout:  *pliGapTimeoutFlag,
+				PLIInterval:    *pliIntervalFlag,
+			},
+			SimulcastLayers: *simulcastLayersFlag,
+			Congestion: client.CongestionConfig{
+				Enabled:        *congestionControlFlag,
+				InitialBitrate: *ccInitialBitrateFlag,
+				MinBitrate:     *ccMinBitrateFlag,
+				MaxBitrate:     *ccMaxBitrateFlag,
+				Tiers:          downgradeTiers,
+			},
+		})
 	} else {
         fmt.Println("Please specify either --client or --server")
     }